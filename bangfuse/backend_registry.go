@@ -0,0 +1,42 @@
+package bangfuse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BackendFactory constructs a KVStore from a backend-specific DSN string,
+// e.g. "riak://host:8087/ns", "file:ns", "file:/var/lib/bang.db" (sqlite),
+// or "s3://bucket/prefix?region=...".
+type BackendFactory func(dsn string) (KVStore, error)
+
+var backendRegistry = map[string]BackendFactory{}
+
+// RegisterBackend makes a KVStore implementation selectable by name via the
+// -backend/-dsn flags shared by mkfs-bangfs/rmbangfs/mount-fuse-bangfs.
+// Backends register themselves from an init() in their own file — see
+// kvstore.go (riak), kvstore_file.go (file), kvstore_sqlite.go (sqlite),
+// and kvstore_s3.go (s3).
+func RegisterBackend(name string, factory BackendFactory) {
+	backendRegistry[name] = factory
+}
+
+// OpenBackend constructs the backend registered as name using dsn.
+func OpenBackend(name, dsn string) (KVStore, error) {
+	factory, ok := backendRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q (available: %s)", name, strings.Join(BackendNames(), ", "))
+	}
+	return factory(dsn)
+}
+
+// BackendNames returns the names of all registered backends, sorted.
+func BackendNames() []string {
+	names := make([]string, 0, len(backendRegistry))
+	for name := range backendRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,77 @@
+//go:build integration
+
+// Integration test driving the go-fuse posixtest suite against a real
+// BangFS mount — requires /dev/fuse and permission to mount FUSE
+// filesystems (CAP_SYS_ADMIN or user_allow_other).
+// Run: go test -tags=integration -v -run TestPosix ./bangfuse/
+
+package bangfuse
+
+import (
+	"io"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/posixtest"
+)
+
+// posixSkip records tests in posixtest.All that BangFS can't pass yet,
+// with the reason, so the skip list doubles as an executable TODO: once a
+// chunk implements the missing semantics, delete the entry here and the
+// suite starts enforcing it.
+var posixSkip = map[string]string{
+	"FcntlFlockSetLk":     "file locking (EnableLocks) is not implemented",
+	"FcntlFlockLocksFile": "file locking (EnableLocks) is not implemented",
+	"DirectIO":            "O_DIRECT is not handled specially",
+	"LseekHoleSeeksToEOF": "sparse-hole seeking is not implemented",
+	"LseekEnxioCheck":     "sparse-hole seeking is not implemented",
+}
+
+// TestPosix mounts a fresh BangFS backed by a scratch-namespace
+// FileKVStore (files under /tmp) and runs every posixtest.All case against it, skipping the
+// ones listed in posixSkip.
+func TestPosix(t *testing.T) {
+	for name, test := range posixtest.All {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			if reason, skip := posixSkip[name]; skip {
+				t.Skip(reason)
+			}
+
+			mnt := mountPosixTestFS(t)
+			test(t, mnt)
+		})
+	}
+}
+
+// mountPosixTestFS brings up a BangFS backed by a scratch FileKVStore
+// namespace, mounts it at a fresh temp dir, and tears both down on test
+// cleanup. Returns the mountpoint.
+func mountPosixTestFS(t *testing.T) string {
+	t.Helper()
+
+	kv, err := NewFileKVStore("posixtest_" + t.Name())
+	if err != nil {
+		t.Fatalf("NewFileKVStore: %v", err)
+	}
+	if err := kv.InitBackend(); err != nil {
+		kv.Close()
+		t.Fatalf("InitBackend: %v", err)
+	}
+
+	bs, err := NewBangServerWithKV(kv)
+	if err != nil {
+		t.Fatalf("NewBangServerWithKV: %v", err)
+	}
+
+	mnt := t.TempDir()
+	if err := bs.Mount(mnt); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	t.Cleanup(func() {
+		bs.Server.Unmount()
+		bs.Close()
+		kv.WipeBackend(io.Discard)
+	})
+
+	return mnt
+}
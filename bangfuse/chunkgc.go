@@ -0,0 +1,232 @@
+package bangfuse
+
+import (
+	"bangfs/bangutil"
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// chunkGC is the background companion to the refcounting DeleteChunk already
+// does inline (see KVStore.DeleteChunk): it retries deletes that failed
+// after the refcount had already dropped to zero, and periodically
+// reconciles refcount drift a crash between a chunk's last DeleteChunk and
+// its caller's next step can leave behind.
+type chunkGC struct {
+	pendingMu sync.Mutex
+	pending   []uint64
+
+	sweepInterval time.Duration
+
+	// prevOrphans holds the refcounts sweep found orphaned last time around,
+	// keyed by chunk key. A key only gets enqueued for deletion once it's
+	// been seen orphaned on two consecutive sweeps (see sweep): a chunk
+	// PutChunk'd mid-scan, before the metadata write that references it has
+	// landed, looks orphan for exactly one sweep and must not be reclaimed.
+	prevOrphans map[uint64]uint64
+
+	sweepsRun        uint64
+	orphansReclaimed uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newChunkGC creates a chunkGC that reconciles drift every sweepInterval.
+// Start must be called to actually run it.
+func newChunkGC(sweepInterval time.Duration) *chunkGC {
+	return &chunkGC{sweepInterval: sweepInterval}
+}
+
+// Enqueue schedules key for a retried DeleteChunk call, for use when a
+// DeleteChunk call already dropped the refcount but the physical delete
+// that followed failed (e.g. a transient backend error).
+func (g *chunkGC) Enqueue(key uint64) {
+	g.pendingMu.Lock()
+	g.pending = append(g.pending, key)
+	g.pendingMu.Unlock()
+}
+
+// PendingDepth reports how many chunk deletions are currently queued for
+// retry.
+func (g *chunkGC) PendingDepth() int {
+	g.pendingMu.Lock()
+	defer g.pendingMu.Unlock()
+	return len(g.pending)
+}
+
+// SweepsRun reports how many mark-and-sweep reconciliation passes have
+// completed since Start.
+func (g *chunkGC) SweepsRun() uint64 {
+	return atomic.LoadUint64(&g.sweepsRun)
+}
+
+// OrphansReclaimed reports how many chunk deletes this gc has driven to
+// completion, across both pending-queue retries and sweep-discovered drift.
+func (g *chunkGC) OrphansReclaimed() uint64 {
+	return atomic.LoadUint64(&g.orphansReclaimed)
+}
+
+// Start launches the background goroutine that drains the pending-delete
+// queue and runs periodic sweeps. Call Stop to shut it down.
+func (g *chunkGC) Start() {
+	g.stop = make(chan struct{})
+	g.done = make(chan struct{})
+	go g.run()
+}
+
+// Stop shuts down the background goroutine and waits for it to exit.
+func (g *chunkGC) Stop() {
+	if g.stop == nil {
+		return
+	}
+	close(g.stop)
+	<-g.done
+}
+
+func (g *chunkGC) run() {
+	defer close(g.done)
+	sweepTicker := time.NewTicker(g.sweepInterval)
+	defer sweepTicker.Stop()
+	retryTicker := time.NewTicker(5 * time.Second)
+	defer retryTicker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-retryTicker.C:
+			g.drainPending()
+		case <-sweepTicker.C:
+			g.sweep()
+		}
+	}
+}
+
+// drainPending makes one retry pass over the pending queue. Keys whose
+// retried DeleteChunk still fails are left on the queue for the next tick,
+// which is the retry/backoff: each failure simply waits for the next
+// retryTicker rather than being retried in a tight loop.
+func (g *chunkGC) drainPending() {
+	g.pendingMu.Lock()
+	keys := g.pending
+	g.pending = nil
+	g.pendingMu.Unlock()
+
+	var retry []uint64
+	for _, key := range keys {
+		op := bangutil.GetTracer().Op("ChunkGC.retryDelete", key, "")
+		if err := gKVStore.DeleteChunk(key); err != nil {
+			op.Error(err)
+			retry = append(retry, key)
+			continue
+		}
+		atomic.AddUint64(&g.orphansReclaimed, 1)
+		op.Done()
+	}
+	if len(retry) > 0 {
+		g.pendingMu.Lock()
+		g.pending = append(g.pending, retry...)
+		g.pendingMu.Unlock()
+	}
+}
+
+// sweep streams every live InodeMeta's chunk list to build the set of chunk
+// keys still in use, then streams the chunk bucket itself looking for keys
+// absent from that live set. A key found orphaned is not reclaimed on the
+// spot: a chunk can be PutChunk'd (and refcount-bumped) concurrently with
+// the metadata scan above, before the write that will reference it lands,
+// and would otherwise look orphan for this one sweep even though it's
+// live. Instead each orphan is only enqueued for a retried delete — once
+// per outstanding reference, since a single DeleteChunk call only drops
+// the refcount by one — once it's been seen orphaned on two consecutive
+// sweeps, which gives any in-flight write a full sweepInterval to land.
+// This is what recovers a chunk whose refcount was left above zero by a
+// crash between an Unlink/Truncate decrementing it and the metadata write
+// that would have made the drop visible.
+func (g *chunkGC) sweep() {
+	atomic.AddUint64(&g.sweepsRun, 1)
+	op := bangutil.GetTracer().Op("ChunkGC.sweep", 0, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	live := make(map[uint64]bool)
+	metaKeys := make(chan string, 64)
+	go func() {
+		if err := gKVStore.ListKeys(ctx, metadataBucket, metaKeys); err != nil {
+			op.Error(err)
+		}
+	}()
+	for keyStr := range metaKeys {
+		inum, err := strconv.ParseUint(keyStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		meta, _, err := gKVStore.Metadata(inum)
+		if err != nil {
+			continue
+		}
+		for _, c := range meta.Chunks {
+			if !c.Hole {
+				live[c.Hash] = true
+			}
+		}
+	}
+
+	chunkKeys := make(chan string, 64)
+	go func() {
+		if err := gKVStore.ListKeys(ctx, chunkBucket, chunkKeys); err != nil {
+			op.Error(err)
+		}
+	}()
+	orphans := make(map[uint64]uint64)
+	for keyStr := range chunkKeys {
+		key, ok := parseChunkKey(keyStr)
+		if !ok || live[key] {
+			continue
+		}
+		count, err := gKVStore.ChunkRefCount(key)
+		if err != nil {
+			continue
+		}
+		orphans[key] = count
+	}
+
+	var reclaimedThisSweep int
+	for key, count := range orphans {
+		if _, confirmed := g.prevOrphans[key]; !confirmed {
+			continue // first sighting; wait for the next sweep to confirm it's still orphaned
+		}
+		for i := uint64(0); i < count; i++ {
+			g.Enqueue(key)
+			reclaimedThisSweep++
+		}
+	}
+	g.prevOrphans = orphans
+	op.Debugf("queued %d orphaned chunk refs for deletion", reclaimedThisSweep)
+	op.Done()
+}
+
+// parseChunkKey recovers the uint64 chunk key from a ListKeys(chunkBucket)
+// string. Most backends format chunk keys as lowercase 16-digit hex (see
+// RiakKVStore/FileKVStore/S3KVStore's "%016x"); SQLiteKVStore uses plain
+// decimal. Trying hex first and falling back to decimal covers every
+// backend without needing a bucket-specific key codec on the interface.
+func parseChunkKey(s string) (uint64, bool) {
+	if key, err := strconv.ParseUint(s, 16, 64); err == nil {
+		return key, true
+	}
+	if key, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return key, true
+	}
+	return 0, false
+}
+
+// gChunkGC is the package-level chunk garbage collector; see chunkGC.
+// chunkGCSweepInterval is deliberately conservative since a sweep reads
+// every InodeMeta and every chunk key in the backend.
+const chunkGCSweepInterval = 30 * time.Minute
+
+var gChunkGC = newChunkGC(chunkGCSweepInterval)
@@ -4,8 +4,11 @@ import (
 	"bangfs/bangutil"
 	bangpb "bangfs/proto"
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"sort"
 	"syscall"
 	"time"
 
@@ -25,6 +28,126 @@ var _ = (fs.NodeMkdirer)((*BangDirNode)(nil))
 var _ = (fs.NodeLookuper)((*BangDirNode)(nil))
 var _ = (fs.NodeRmdirer)((*BangDirNode)(nil))
 var _ = (fs.NodeUnlinker)((*BangDirNode)(nil))
+var _ = (fs.NodeRenamer)((*BangDirNode)(nil))
+var _ = (fs.NodeSymlinker)((*BangDirNode)(nil))
+var _ = (fs.NodeLinker)((*BangDirNode)(nil))
+
+// RENAME_NOREPLACE mirrors the renameat2(2) flag of the same name. go-fuse
+// only exports RENAME_EXCHANGE as a constant, so we define this one
+// ourselves to decode the flags argument Rename receives.
+const RENAME_NOREPLACE = 0x1
+
+// maxRenameRetries bounds how many times Rename re-reads and retries its
+// CAS sequence after a conflicting write before giving up with EIO.
+const maxRenameRetries = 10
+
+// childEntries returns inum's children, reading them from the dentry
+// index when dentry mode is enabled for this namespace and falling back
+// to the embedded ChildEntries on dir_meta otherwise.
+func childEntries(inum uint64, dir_meta *bangpb.InodeMeta) ([]*bangpb.ChildEntry, error) {
+	dentryMode, err := gKVStore.DentryMode()
+	if err != nil {
+		return nil, fmt.Errorf("checking dentry mode: %w", err)
+	}
+	if !dentryMode {
+		return dir_meta.GetChildEntries(), nil
+	}
+	return gKVStore.ListChildren(inum)
+}
+
+// findChildEntry returns the entry named name, or nil if absent. entries is
+// re-fetched fresh on every call (the dentry index/embedded list isn't kept
+// sorted at rest), so this sorts a copy and binary-searches rather than
+// doing a true O(log n) lookup against a persistent structure — still a
+// clear win over a linear scan once a directory has more than a handful of
+// children, which is the case this exists for. Sorting a copy (rather than
+// entries itself) matters because callers hand in the same backing array
+// other concurrent Lookups/renames on the directory are reading or holding
+// onto; sorting in place would race with them and silently reorder
+// whatever they see.
+func findChildEntry(entries []*bangpb.ChildEntry, name string) *bangpb.ChildEntry {
+	sorted := make([]*bangpb.ChildEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	idx := sort.Search(len(sorted), func(i int) bool { return sorted[i].Name >= name })
+	if idx < len(sorted) && sorted[idx].Name == name {
+		return sorted[idx]
+	}
+	return nil
+}
+
+// withoutChildEntry returns entries with the entry named name removed.
+func withoutChildEntry(entries []*bangpb.ChildEntry, name string) []*bangpb.ChildEntry {
+	out := make([]*bangpb.ChildEntry, 0, len(entries))
+	for _, c := range entries {
+		if c.Name != name {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// touchDir applies now and nlinkDelta to inum's metadata via mutateDirMeta.
+// Used in dentry mode, where the child link itself lives in its own dentry
+// object and the parent only needs its times (and, for subdirectories, its
+// refcounted Nlink) kept current.
+func touchDir(inum uint64, nlinkDelta int32, now int64) error {
+	errno := mutateDirMeta(inum, 0, func(dm *bangpb.InodeMeta) syscall.Errno {
+		dm.MtimeNs = now
+		dm.CtimeNs = now
+		dm.Nlink += uint32(nlinkDelta)
+		return 0
+	})
+	if errno != 0 {
+		return fmt.Errorf("updating metadata for dir inode: errno %d", errno)
+	}
+	return nil
+}
+
+// defaultMutateDirMetaAttempts bounds how many times mutateDirMeta retries a
+// conflicting CAS write before giving up with EIO.
+const defaultMutateDirMetaAttempts = 8
+
+// mutateDirMeta reads inum's metadata, applies fn to it, and CAS-writes it
+// back, retrying with jittered backoff whenever the write loses a vclock
+// race (see ErrVClockConflict) instead of immediately surfacing EIO the way
+// the embedded-ChildEntries branches of Create/Mkdir/Rmdir/Unlink used to.
+// fn may return a non-zero errno to short-circuit for a logical error
+// (EEXIST, ENOENT, ...) found on the freshly re-read metadata, in which
+// case mutateDirMeta returns it immediately without writing anything back.
+func mutateDirMeta(inum uint64, maxAttempts int, fn func(*bangpb.InodeMeta) syscall.Errno) syscall.Errno {
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMutateDirMetaAttempts
+	}
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		meta, vclock, err := gKVStore.Metadata(inum)
+		if err != nil {
+			return syscall.EIO
+		}
+		if errno := fn(meta); errno != 0 {
+			return errno
+		}
+		if _, err := gKVStore.UpdateMetadata(inum, meta, vclock); err != nil {
+			if errors.Is(err, ErrVClockConflict) {
+				time.Sleep(mutateDirMetaBackoff(attempt))
+				continue
+			}
+			return syscall.EIO
+		}
+		return 0
+	}
+	return syscall.EIO
+}
+
+// mutateDirMetaBackoff returns a jittered delay that grows with attempt,
+// capped at 50ms so a hot directory doesn't stall FUSE callers for long.
+func mutateDirMetaBackoff(attempt int) time.Duration {
+	base := time.Duration(uint64(1)<<uint(attempt)) * time.Millisecond
+	if base > 50*time.Millisecond {
+		base = 50 * time.Millisecond
+	}
+	return base/2 + time.Duration(rand.Int63n(int64(base/2+1)))
+}
 
 // Readdir lists directory contents and prepends . (self inode) and .. (parent inode) to the real children.
 func (d *BangDirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
@@ -42,28 +165,75 @@ func (d *BangDirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno)
 		return nil, syscall.EINVAL // TODO: approrpirate err cde
 	}
 
-	// . and .. must be returned by the FUSE server; the kernel doesn't add them
-	entries := []fuse.DirEntry{
-		{Name: ".", Ino: inum, Mode: dir_meta.Mode},
-		{Name: "..", Ino: dir_meta.ParentInode, Mode: syscall.S_IFDIR},
+	children, err := childEntries(inum, dir_meta)
+	if err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
+
+	op.Done()
+	return newDirEntryStream(inum, dir_meta, children), 0
+}
+
+// dirEntryStream is a streaming fs.DirStream backing Readdir: it holds the
+// already-fetched ChildEntry slice plus a cursor instead of materializing
+// every child's fuse.DirEntry (and the per-child Metadata round-trip that
+// used to take) up front, so a directory with hundreds of thousands of
+// entries doesn't block the FUSE thread or blow memory building one giant
+// slice. Entries are drained lazily as the kernel calls Next, and since the
+// stream is just (children slice, cursor) it can be rebuilt from scratch
+// and fast-forwarded by re-calling Next, which is how go-fuse's bridge
+// already implements seekdir/opendir-offset resumption on top of a
+// DirStream — no extra Seek method is needed here.
+type dirEntryStream struct {
+	self    fuse.DirEntry
+	parent  fuse.DirEntry
+	entries []*bangpb.ChildEntry
+	cursor  int // 0 and 1 cover self/parent; cursor-2 indexes into entries
+}
+
+func newDirEntryStream(inum uint64, dir_meta *bangpb.InodeMeta, children []*bangpb.ChildEntry) fs.DirStream {
+	return &dirEntryStream{
+		self:    fuse.DirEntry{Name: ".", Ino: inum, Mode: dir_meta.Mode},
+		parent:  fuse.DirEntry{Name: "..", Ino: dir_meta.ParentInode, Mode: syscall.S_IFDIR},
+		entries: children,
+	}
+}
+
+func (s *dirEntryStream) HasNext() bool {
+	return s.cursor < len(s.entries)+2
+}
+
+// Next materializes the next entry. Mode comes straight from the cached
+// ChildEntry.Mode populated by Create/Mkdir/Symlink/Link/rename when
+// available; a zero Mode (no valid mode_t is ever zero — every real mode
+// carries a non-zero file-type bit) means the entry predates that cache, so
+// it falls back to the old per-child Metadata lookup just for that one
+// straggler.
+func (s *dirEntryStream) Next() (fuse.DirEntry, syscall.Errno) {
+	defer func() { s.cursor++ }()
+
+	switch s.cursor {
+	case 0:
+		return s.self, 0
+	case 1:
+		return s.parent, 0
 	}
-	for _, child := range dir_meta.GetChildEntries() {
-		child_meta, _, err := gKVStore.Metadata(child.Inode)
+
+	c := s.entries[s.cursor-2]
+	mode := c.Mode
+	if mode == 0 {
+		child_meta, _, err := gKVStore.Metadata(c.Inode)
 		if err != nil {
-			op.Error(err)
-			continue // TODO: handle error
+			return fuse.DirEntry{}, syscall.EIO
 		}
-		entries = append(entries, fuse.DirEntry{
-			Ino:  child.Inode,
-			Name: child_meta.Name,
-			Mode: child_meta.Mode,
-		})
+		mode = child_meta.Mode
 	}
-
-	op.Done()
-	return fs.NewListDirStream(entries), 0 // TODO: make this an actual stream?
+	return fuse.DirEntry{Ino: c.Inode, Name: c.Name, Mode: mode}, 0
 }
 
+func (s *dirEntryStream) Close() {}
+
 // Create creates a regular file
 func (d *BangDirNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 
@@ -71,12 +241,21 @@ func (d *BangDirNode) Create(ctx context.Context, name string, flags uint32, mod
 	op := bangutil.GetTracer().Op("Create", inum, name)
 
 	// Read the directory children from the backend.
-	dir_meta, dir_vclock, err := gKVStore.Metadata(inum)
+	dir_meta, _, err := gKVStore.Metadata(inum)
 	if err != nil {
 		op.Error(fmt.Errorf("getting metadata: %v", err))
 		return nil, nil, 0, syscall.EIO
 	}
-	child_entries := dir_meta.GetChildEntries()
+	dentryMode, err := gKVStore.DentryMode()
+	if err != nil {
+		op.Error(fmt.Errorf("checking dentry mode: %v", err))
+		return nil, nil, 0, syscall.EIO
+	}
+	child_entries, err := childEntries(inum, dir_meta)
+	if err != nil {
+		op.Error(err)
+		return nil, nil, 0, syscall.EIO
+	}
 	for _, c := range child_entries {
 		if name == c.Name {
 			return nil, nil, 0, syscall.EEXIST
@@ -85,7 +264,11 @@ func (d *BangDirNode) Create(ctx context.Context, name string, flags uint32, mod
 
 	// Create a new backend metadata struct for the new file and store it in the backend.
 	now := time.Now().UnixNano() // TODO: check why time fields don't use uint64 but int64
-	new_inum := gInumgen.NextId()
+	new_inum, err := gInumgen.NextId()
+	if err != nil {
+		op.Error(fmt.Errorf("generating inode id: %v", err))
+		return nil, nil, 0, syscall.EIO
+	}
 	new_file_meta := &bangpb.InodeMeta{
 		Name:        name,
 		ParentInode: inum,
@@ -105,15 +288,34 @@ func (d *BangDirNode) Create(ctx context.Context, name string, flags uint32, mod
 		return nil, nil, 0, syscall.EIO
 	}
 
-	// Add the new file link to the directory and try to update it.
-	// TODO: address possible condition if the directory metadata has been concurrently modified.
-	dir_meta.ChildEntries = append(child_entries, &bangpb.ChildEntry{Name: name, Inode: new_inum})
-	dir_meta.MtimeNs = now
-	dir_meta.CtimeNs = now
-	_, err = gKVStore.UpdateMetadata(inum, dir_meta, dir_vclock)
-	if err != nil {
-		op.Error(fmt.Errorf("updating metadata for dir inode: %v", err))
-		return nil, nil, 0, syscall.EIO
+	// Add the new file link to the directory. In dentry mode this only
+	// touches the child's own dentry plus the parent's times; otherwise
+	// it's a full CAS rewrite of the embedded ChildEntries.
+	if dentryMode {
+		if err := gKVStore.PutDentry(inum, &bangpb.ChildEntry{Name: name, Inode: new_inum, Mode: new_file_meta.Mode}); err != nil {
+			op.Error(fmt.Errorf("storing dentry: %v", err))
+			return nil, nil, 0, syscall.EIO
+		}
+		if err := touchDir(inum, 0, now); err != nil {
+			op.Error(err)
+			return nil, nil, 0, syscall.EIO
+		}
+	} else {
+		errno := mutateDirMeta(inum, 0, func(dm *bangpb.InodeMeta) syscall.Errno {
+			for _, c := range dm.ChildEntries {
+				if c.Name == name {
+					return syscall.EEXIST
+				}
+			}
+			dm.ChildEntries = append(dm.ChildEntries, &bangpb.ChildEntry{Name: name, Inode: new_inum, Mode: new_file_meta.Mode})
+			dm.MtimeNs = now
+			dm.CtimeNs = now
+			return 0
+		})
+		if errno != 0 {
+			op.Error(fmt.Errorf("updating metadata for dir inode: errno %d", errno))
+			return nil, nil, 0, errno
+		}
 	}
 
 	inode := d.NewInode(ctx, &BangFileNode{} /* ops */, fs.StableAttr{Mode: syscall.S_IFREG, Ino: new_inum})
@@ -122,7 +324,10 @@ func (d *BangDirNode) Create(ctx context.Context, name string, flags uint32, mod
 		VClock:   new_vclock,
 		Metadata: new_file_meta,
 		Flags:    flags,
+		pages:    newPageBuffer(),
+		prefetch: newPrefetchState(),
 	}
+	gOpenHandles.Acquire(new_inum)
 
 	op.Done()
 	return inode, fh, 0, 0
@@ -134,13 +339,22 @@ func (d *BangDirNode) Mkdir(ctx context.Context, name string, mode uint32, out *
 	op := bangutil.GetTracer().Op("Mkdir", inum, name)
 
 	// Read the directory children from the backend.
-	dir_meta, vclock, err := gKVStore.Metadata(inum)
+	dir_meta, _, err := gKVStore.Metadata(inum)
 	if err != nil {
 		op.Error(fmt.Errorf("getting metadata: %v", err))
 		return nil, syscall.EIO
 	}
+	dentryMode, err := gKVStore.DentryMode()
+	if err != nil {
+		op.Error(fmt.Errorf("checking dentry mode: %v", err))
+		return nil, syscall.EIO
+	}
 	// TODO: check Mkdir (and Create) should check for existing entries? or does Lookup get called?
-	child_entries := dir_meta.GetChildEntries()
+	child_entries, err := childEntries(inum, dir_meta)
+	if err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
 	for _, c := range child_entries {
 		if name == c.Name {
 			op.Error(fmt.Errorf("exists: %v", err))
@@ -150,7 +364,11 @@ func (d *BangDirNode) Mkdir(ctx context.Context, name string, mode uint32, out *
 
 	// Create a new backend metadata struct for the new file and store it in the backend.
 	now := time.Now().UnixNano() // TODO: check why time fields don't use uint64 but int64
-	new_inum := gInumgen.NextId()
+	new_inum, err := gInumgen.NextId()
+	if err != nil {
+		op.Error(fmt.Errorf("generating inode id: %v", err))
+		return nil, syscall.EIO
+	}
 	new_dir_meta := &bangpb.InodeMeta{
 		Name:         name,
 		ParentInode:  inum,
@@ -169,19 +387,210 @@ func (d *BangDirNode) Mkdir(ctx context.Context, name string, mode uint32, out *
 		return nil, syscall.EIO
 	}
 
-	// Add the new file link to the directory and try to update it.
-	// TODO: address possible condition if the directory metadata has been concurrently modified.
-	dir_meta.ChildEntries = append(child_entries, &bangpb.ChildEntry{Name: name, Inode: new_inum})
-	dir_meta.MtimeNs = now
-	dir_meta.CtimeNs = now
-	dir_meta.Nlink++ // new subdir's ".." points back to us
-	_, err = gKVStore.UpdateMetadata(inum, dir_meta, vclock)
+	// Add the new subdir link to the parent. In dentry mode this only
+	// touches the child's own dentry plus a refcounted Nlink update on
+	// the parent (the new subdir's ".." points back to us); otherwise
+	// it's a full CAS rewrite of the embedded ChildEntries.
+	if dentryMode {
+		if err := gKVStore.PutDentry(inum, &bangpb.ChildEntry{Name: name, Inode: new_inum, Mode: new_dir_meta.Mode}); err != nil {
+			op.Error(fmt.Errorf("storing dentry: %v", err))
+			return nil, syscall.EIO
+		}
+		if err := touchDir(inum, 1, now); err != nil {
+			op.Error(err)
+			return nil, syscall.EIO
+		}
+	} else {
+		errno := mutateDirMeta(inum, 0, func(dm *bangpb.InodeMeta) syscall.Errno {
+			for _, c := range dm.ChildEntries {
+				if c.Name == name {
+					return syscall.EEXIST
+				}
+			}
+			dm.ChildEntries = append(dm.ChildEntries, &bangpb.ChildEntry{Name: name, Inode: new_inum, Mode: new_dir_meta.Mode})
+			dm.MtimeNs = now
+			dm.CtimeNs = now
+			dm.Nlink++ // new subdir's ".." points back to us
+			return 0
+		})
+		if errno != 0 {
+			op.Error(fmt.Errorf("updating metadata for dir inode: errno %d", errno))
+			return nil, errno
+		}
+	}
+
+	inode := d.NewInode(ctx, &BangDirNode{} /* ops */, fs.StableAttr{Mode: syscall.S_IFDIR, Ino: new_inum})
+	op.Done()
+	return inode, 0
+}
+
+// Symlink creates a symbolic link named name that points at target. The
+// target string is stored verbatim and is never resolved or validated by
+// BangFS itself (that's left to whatever eventually calls Readlink/follows
+// the link), matching how regular filesystems treat symlink targets as
+// opaque bytes.
+func (d *BangDirNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	inum := d.StableAttr().Ino
+	op := bangutil.GetTracer().Op("Symlink", inum, name)
+
+	dir_meta, _, err := gKVStore.Metadata(inum)
 	if err != nil {
-		op.Error(fmt.Errorf("updating metadata for dir inode: %v", err))
+		op.Error(fmt.Errorf("getting metadata: %v", err))
 		return nil, syscall.EIO
 	}
+	dentryMode, err := gKVStore.DentryMode()
+	if err != nil {
+		op.Error(fmt.Errorf("checking dentry mode: %v", err))
+		return nil, syscall.EIO
+	}
+	child_entries, err := childEntries(inum, dir_meta)
+	if err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
+	for _, c := range child_entries {
+		if name == c.Name {
+			return nil, syscall.EEXIST
+		}
+	}
 
-	inode := d.NewInode(ctx, &BangDirNode{} /* ops */, fs.StableAttr{Mode: syscall.S_IFDIR, Ino: new_inum})
+	now := time.Now().UnixNano()
+	new_inum, err := gInumgen.NextId()
+	if err != nil {
+		op.Error(fmt.Errorf("generating inode id: %v", err))
+		return nil, syscall.EIO
+	}
+	new_link_meta := &bangpb.InodeMeta{
+		Name:          name,
+		ParentInode:   inum,
+		Mode:          syscall.S_IFLNK | 0777,
+		Uid:           uint32(os.Getuid()),
+		Gid:           uint32(os.Getgid()),
+		CtimeNs:       now,
+		MtimeNs:       now,
+		AtimeNs:       now,
+		Size:          uint64(len(target)),
+		SymlinkTarget: target,
+		Nlink:         1,
+	}
+	if _, err := gKVStore.PutMetadata(new_inum, new_link_meta); err != nil {
+		op.Error(fmt.Errorf("storing the new symlink metadata: %v", err))
+		return nil, syscall.EIO
+	}
+
+	if dentryMode {
+		if err := gKVStore.PutDentry(inum, &bangpb.ChildEntry{Name: name, Inode: new_inum, Mode: new_link_meta.Mode}); err != nil {
+			op.Error(fmt.Errorf("storing dentry: %v", err))
+			return nil, syscall.EIO
+		}
+		if err := touchDir(inum, 0, now); err != nil {
+			op.Error(err)
+			return nil, syscall.EIO
+		}
+	} else {
+		errno := mutateDirMeta(inum, 0, func(dm *bangpb.InodeMeta) syscall.Errno {
+			for _, c := range dm.ChildEntries {
+				if c.Name == name {
+					return syscall.EEXIST
+				}
+			}
+			dm.ChildEntries = append(dm.ChildEntries, &bangpb.ChildEntry{Name: name, Inode: new_inum, Mode: new_link_meta.Mode})
+			dm.MtimeNs = now
+			dm.CtimeNs = now
+			return 0
+		})
+		if errno != 0 {
+			op.Error(fmt.Errorf("updating metadata for dir inode: errno %d", errno))
+			return nil, errno
+		}
+	}
+
+	inode := d.NewInode(ctx, &BangSymlinkNode{}, fs.StableAttr{Mode: syscall.S_IFLNK, Ino: new_inum})
+	op.Done()
+	return inode, 0
+}
+
+// Link creates name as a new hard link to the existing inode behind
+// target. Regular files and symlinks may be hardlinked; directories are
+// rejected with EPERM, to keep the tree free of cycles, matching the usual
+// POSIX restriction.
+func (d *BangDirNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	inum := d.StableAttr().Ino
+	target_inum := target.EmbeddedInode().StableAttr().Ino
+	op := bangutil.GetTracer().Op("Link", inum, name)
+
+	target_meta, target_vclock, err := gKVStore.Metadata(target_inum)
+	if err != nil {
+		op.Error(fmt.Errorf("getting target metadata: %v", err))
+		return nil, syscall.EIO
+	}
+	if IsDir(target_meta) {
+		op.Error(fmt.Errorf("cannot hardlink a directory"))
+		return nil, syscall.EPERM
+	}
+
+	dir_meta, _, err := gKVStore.Metadata(inum)
+	if err != nil {
+		op.Error(fmt.Errorf("getting metadata: %v", err))
+		return nil, syscall.EIO
+	}
+	dentryMode, err := gKVStore.DentryMode()
+	if err != nil {
+		op.Error(fmt.Errorf("checking dentry mode: %v", err))
+		return nil, syscall.EIO
+	}
+	child_entries, err := childEntries(inum, dir_meta)
+	if err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
+	for _, c := range child_entries {
+		if name == c.Name {
+			return nil, syscall.EEXIST
+		}
+	}
+
+	now := time.Now().UnixNano()
+	target_meta.Nlink++
+	target_meta.CtimeNs = now
+	if _, err := gKVStore.UpdateMetadata(target_inum, target_meta, target_vclock); err != nil {
+		op.Error(fmt.Errorf("incrementing target nlink: %v", err))
+		return nil, syscall.EIO
+	}
+
+	if dentryMode {
+		if err := gKVStore.PutDentry(inum, &bangpb.ChildEntry{Name: name, Inode: target_inum, Mode: target_meta.Mode}); err != nil {
+			op.Error(fmt.Errorf("storing dentry: %v", err))
+			return nil, syscall.EIO
+		}
+		if err := touchDir(inum, 0, now); err != nil {
+			op.Error(err)
+			return nil, syscall.EIO
+		}
+	} else {
+		errno := mutateDirMeta(inum, 0, func(dm *bangpb.InodeMeta) syscall.Errno {
+			for _, c := range dm.ChildEntries {
+				if c.Name == name {
+					return syscall.EEXIST
+				}
+			}
+			dm.ChildEntries = append(dm.ChildEntries, &bangpb.ChildEntry{Name: name, Inode: target_inum, Mode: target_meta.Mode})
+			dm.MtimeNs = now
+			dm.CtimeNs = now
+			return 0
+		})
+		if errno != 0 {
+			op.Error(fmt.Errorf("updating metadata for dir inode: errno %d", errno))
+			return nil, errno
+		}
+	}
+
+	var inode *fs.Inode
+	if IsSymlink(target_meta) {
+		inode = d.NewInode(ctx, &BangSymlinkNode{}, fs.StableAttr{Mode: syscall.S_IFLNK, Ino: target_inum})
+	} else {
+		inode = d.NewInode(ctx, &BangFileNode{}, fs.StableAttr{Mode: syscall.S_IFREG, Ino: target_inum})
+	}
 	op.Done()
 	return inode, 0
 }
@@ -198,31 +607,34 @@ func (d *BangDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOu
 		return nil, syscall.EIO
 	}
 
-	// Iterate through to find the file
-	// TODO: make a more efficient data structure. This is a linear search.
-	child_entries := dir_meta.GetChildEntries()
-	for _, c := range child_entries {
-		if name == c.Name {
-			found_inum := c.Inode
-			found_meta, _, err := gKVStore.Metadata(found_inum)
-			if err != nil {
-				op.Error(fmt.Errorf("getting metadata for found inode"))
-				return nil, syscall.EIO
-			}
-			// TODO: check why return a NewInode and set the mode and ops, maybe the number is sufficient.
-			if IsDir(found_meta) {
-				return d.NewInode(ctx, &BangDirNode{}, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: found_inum}), 0
-			} else if IsFile(found_meta) {
-				return d.NewInode(ctx, &BangFileNode{}, fs.StableAttr{Mode: fuse.S_IFREG, Ino: found_inum}), 0
-			} else {
-				op.Error(fmt.Errorf("found inode is neither file nor directory"))
-				return nil, syscall.ENOTSUP
-			}
-		}
+	child_entries, err := childEntries(inum, dir_meta)
+	if err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
+	c := findChildEntry(child_entries, name)
+	if c == nil {
+		op.Error(fmt.Errorf("could not find file"))
+		return nil, syscall.ENOENT
 	}
 
-	op.Error(fmt.Errorf("could not find file"))
-	return nil, syscall.ENOENT
+	found_inum := c.Inode
+	found_meta, _, err := gKVStore.Metadata(found_inum)
+	if err != nil {
+		op.Error(fmt.Errorf("getting metadata for found inode"))
+		return nil, syscall.EIO
+	}
+	// TODO: check why return a NewInode and set the mode and ops, maybe the number is sufficient.
+	if IsDir(found_meta) {
+		return d.NewInode(ctx, &BangDirNode{}, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: found_inum}), 0
+	} else if IsFile(found_meta) {
+		return d.NewInode(ctx, &BangFileNode{}, fs.StableAttr{Mode: fuse.S_IFREG, Ino: found_inum}), 0
+	} else if IsSymlink(found_meta) {
+		return d.NewInode(ctx, &BangSymlinkNode{}, fs.StableAttr{Mode: fuse.S_IFLNK, Ino: found_inum}), 0
+	} else {
+		op.Error(fmt.Errorf("found inode is neither file, directory, nor symlink"))
+		return nil, syscall.ENOTSUP
+	}
 }
 
 func (d *BangDirNode) Rmdir(ctx context.Context, name string) syscall.Errno {
@@ -232,23 +644,30 @@ func (d *BangDirNode) Rmdir(ctx context.Context, name string) syscall.Errno {
 	// TODO: check if needed to verify if its a directory
 
 	// Read the directory children from the backend.
-	dir_meta, vclock, err := gKVStore.Metadata(inum)
+	dir_meta, _, err := gKVStore.Metadata(inum)
 	if err != nil {
 		op.Error(fmt.Errorf("getting metadata: %v", err))
 		return syscall.EIO
 	}
+	dentryMode, err := gKVStore.DentryMode()
+	if err != nil {
+		op.Error(fmt.Errorf("checking dentry mode: %v", err))
+		return syscall.EIO
+	}
 	// TODO: check Mkdir (and Create) should check for existing entries? or does Lookup get called?
-	child_entries := dir_meta.GetChildEntries()
-	new_child_entries := []*bangpb.ChildEntry{}
+	child_entries, err := childEntries(inum, dir_meta)
+	if err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
 	found := false
 	var inum_to_delete uint64
 	for _, c := range child_entries {
 		if name == c.Name {
 			found = true
 			inum_to_delete = c.Inode
-			continue
+			break
 		}
-		new_child_entries = append(new_child_entries, c)
 	}
 	if !found {
 		op.Error(fmt.Errorf("not found"))
@@ -261,18 +680,52 @@ func (d *BangDirNode) Rmdir(ctx context.Context, name string) syscall.Errno {
 		op.Error(fmt.Errorf("retrieving child directory metadata: %v", err))
 		return syscall.EIO
 	}
-	if len(to_delete_meta.GetChildEntries()) > 0 {
+	to_delete_children, err := childEntries(inum_to_delete, to_delete_meta)
+	if err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
+	if len(to_delete_children) > 0 {
 		op.Error(fmt.Errorf("directory not empty"))
 		return syscall.ENOTEMPTY
 	}
 
-	// TODO: correctly modify inode change time here
-	dir_meta.ChildEntries = new_child_entries
-	dir_meta.Nlink-- // removed subdir's ".." no longer points to us
-	_, err = gKVStore.UpdateMetadata(inum, dir_meta, vclock)
-	if err != nil {
-		op.Error(fmt.Errorf("updating metadata for dir inode: %v", err))
-		return syscall.EIO
+	// Remove the subdir link from the parent. In dentry mode this only
+	// touches the child's own dentry plus a refcounted Nlink update on
+	// the parent; otherwise it's a full CAS rewrite of the embedded
+	// ChildEntries.
+	if dentryMode {
+		if err := gKVStore.DeleteDentry(inum, name); err != nil {
+			op.Error(fmt.Errorf("deleting dentry: %v", err))
+			return syscall.EIO
+		}
+		if err := touchDir(inum, -1, time.Now().UnixNano()); err != nil {
+			op.Error(err)
+			return syscall.EIO
+		}
+	} else {
+		// TODO: correctly modify inode change time here
+		errno := mutateDirMeta(inum, 0, func(dm *bangpb.InodeMeta) syscall.Errno {
+			updated := []*bangpb.ChildEntry{}
+			found := false
+			for _, c := range dm.ChildEntries {
+				if name == c.Name {
+					found = true
+					continue
+				}
+				updated = append(updated, c)
+			}
+			if !found {
+				return syscall.ENOENT
+			}
+			dm.ChildEntries = updated
+			dm.Nlink-- // removed subdir's ".." no longer points to us
+			return 0
+		})
+		if errno != 0 {
+			op.Error(fmt.Errorf("updating metadata for dir inode: errno %d", errno))
+			return errno
+		}
 	}
 
 	if err = gKVStore.DeleteMetadata(inum_to_delete, to_delete_vclock); err != nil {
@@ -289,63 +742,412 @@ func (d *BangDirNode) Unlink(ctx context.Context, name string) syscall.Errno {
 	op := bangutil.GetTracer().Op("Unlink", inum, name)
 
 	// Read the directory children from the backend.
-	dirMeta, vclock, err := gKVStore.Metadata(inum)
+	dirMeta, _, err := gKVStore.Metadata(inum)
 	if err != nil {
 		op.Error(fmt.Errorf("getting metadata: %v", err))
 		return syscall.EIO
 	}
+	dentryMode, err := gKVStore.DentryMode()
+	if err != nil {
+		op.Error(fmt.Errorf("checking dentry mode: %v", err))
+		return syscall.EIO
+	}
 
 	// TODO: check that this is a regular file? the kernel seems to do this already.
 
 	// TODO: check Mkdir (and Create) should check existing entries? or does Lookup get called?
-	child_entries := dirMeta.GetChildEntries()
-	updated_child_entries := []*bangpb.ChildEntry{}
+	child_entries, err := childEntries(inum, dirMeta)
+	if err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
 	found := false
 	var inum_to_delete uint64
 	for _, c := range child_entries {
 		if name == c.Name {
 			found = true
 			inum_to_delete = c.Inode
-			continue
+			break
 		}
-		updated_child_entries = append(updated_child_entries, c)
 	}
 	if !found {
 		op.Error(fmt.Errorf("not found"))
 		return syscall.ENOENT
 	}
 
-	dirMeta.ChildEntries = updated_child_entries
-	//dirMeta.MtimeNs = now // TODO: check which of these to modify
-	//dirMeta.CtimeNs = now
-	_, err = gKVStore.UpdateMetadata(inum, dirMeta, vclock)
-	if err != nil {
-		op.Error(fmt.Errorf("updating metadata for dir inode: %v", err))
-		return syscall.EIO
+	// Remove the file link from the directory. In dentry mode this only
+	// touches the child's own dentry plus the parent's times; otherwise
+	// it's a full CAS rewrite of the embedded ChildEntries.
+	if dentryMode {
+		if err := gKVStore.DeleteDentry(inum, name); err != nil {
+			op.Error(fmt.Errorf("deleting dentry: %v", err))
+			return syscall.EIO
+		}
+		if err := touchDir(inum, 0, time.Now().UnixNano()); err != nil {
+			op.Error(err)
+			return syscall.EIO
+		}
+	} else {
+		errno := mutateDirMeta(inum, 0, func(dm *bangpb.InodeMeta) syscall.Errno {
+			updated := []*bangpb.ChildEntry{}
+			found := false
+			for _, c := range dm.ChildEntries {
+				if name == c.Name {
+					found = true
+					continue
+				}
+				updated = append(updated, c)
+			}
+			if !found {
+				return syscall.ENOENT
+			}
+			dm.ChildEntries = updated
+			//dm.MtimeNs = now // TODO: check which of these to modify
+			//dm.CtimeNs = now
+			return 0
+		})
+		if errno != 0 {
+			op.Error(fmt.Errorf("updating metadata for dir inode: errno %d", errno))
+			return errno
+		}
 	}
 
-	// Look up the file that we unlinked (now orphaned since we dont have hardlinks)
+	// Drop a link on the unlinked inode. With Link now able to create extra
+	// ChildEntries pointing at the same inode, Nlink (not the ChildEntry
+	// removal above) is what decides whether the inode is actually gone;
+	// it's only deleted once Nlink reaches zero AND there are no open file
+	// handles left on it (handled by finalizeIfOrphaned, also called from
+	// BangFH.Release for the case where an open handle outlives the unlink).
 	unlinked_file_meta, unlinked_file_vclock, err := gKVStore.Metadata(inum_to_delete)
 	if err != nil {
 		op.Error(fmt.Errorf("lookup of unlinked file"))
 		return syscall.EIO
 	}
-
-	// Delete the chunks. Don't bother updating the metadata since it gets deleted below.
-	chunkRefs := unlinked_file_meta.Chunks
-	for _, c := range chunkRefs {
-		chunk_key := c.Hash
-		if err = gKVStore.DeleteChunk(chunk_key); err != nil {
-			op.Error(fmt.Errorf("deleting chunk %v", chunk_key)) // garbage collect later
-		}
+	unlinked_file_meta.Nlink--
+	unlinked_file_meta.CtimeNs = time.Now().UnixNano()
+	if _, err := gKVStore.UpdateMetadata(inum_to_delete, unlinked_file_meta, unlinked_file_vclock); err != nil {
+		op.Error(fmt.Errorf("decrementing nlink on unlinked file: %v", err))
+		return syscall.EIO
 	}
 
-	// Delete the file metadata itself
-	// TODO: make this work even if the file inode changed between reading and deleting it
-	if err = gKVStore.DeleteMetadata(inum_to_delete, unlinked_file_vclock); err != nil {
-		op.Error(fmt.Errorf("deleting file metadata: %v", err))
+	if err := finalizeIfOrphaned(inum_to_delete); err != nil {
+		op.Error(fmt.Errorf("finalizing unlinked file: %v", err))
+		return syscall.EIO
 	}
 
 	op.Done()
 	return 0
 }
+
+// Rename moves (or, with RENAME_EXCHANGE, swaps) a child entry between two
+// directories. Because a single rename can touch up to three inodes under
+// three independent vclocks (the source dir, the destination dir, and the
+// moved child's own ParentInode), the whole resolve-and-write sequence below
+// is retried from scratch a bounded number of times whenever a CAS write
+// loses a race. renameOnce does not check for ErrVClockConflict: any error
+// from the write phase (renameMove/renameExchange), conflict or not, is
+// retried, and EIO is returned once maxRenameRetries attempts have failed.
+func (d *BangDirNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	inum := d.StableAttr().Ino
+	dstDir, ok := newParent.(*BangDirNode)
+	if !ok {
+		return syscall.EINVAL
+	}
+	newInum := dstDir.StableAttr().Ino
+	op := bangutil.GetTracer().Op("Rename", inum, name)
+
+	for attempt := 0; attempt < maxRenameRetries; attempt++ {
+		retry, errno := renameOnce(inum, name, newInum, newName, flags, op)
+		if !retry {
+			if errno == 0 {
+				op.Done()
+			}
+			return errno
+		}
+	}
+	op.Error(fmt.Errorf("gave up after %d conflicting rename attempts", maxRenameRetries))
+	return syscall.EIO
+}
+
+// renameOnce resolves and performs a single rename attempt. It returns
+// retry=true when any step of the write phase failed (typically a write
+// that lost a race against a concurrent mutation) and the whole attempt
+// should be re-read and retried; otherwise errno is the final result (0 on
+// success).
+func renameOnce(inum uint64, name string, newInum uint64, newName string, flags uint32, op *bangutil.TraceOp) (retry bool, errno syscall.Errno) {
+	sameDir := inum == newInum
+	exchange := flags&fs.RENAME_EXCHANGE != 0
+	noReplace := flags&RENAME_NOREPLACE != 0
+
+	srcMeta, srcVclock, err := gKVStore.Metadata(inum)
+	if err != nil {
+		op.Error(fmt.Errorf("getting source dir metadata: %v", err))
+		return false, syscall.EIO
+	}
+	dentryMode, err := gKVStore.DentryMode()
+	if err != nil {
+		op.Error(fmt.Errorf("checking dentry mode: %v", err))
+		return false, syscall.EIO
+	}
+	srcChildren, err := childEntries(inum, srcMeta)
+	if err != nil {
+		op.Error(err)
+		return false, syscall.EIO
+	}
+	srcEntry := findChildEntry(srcChildren, name)
+	if srcEntry == nil {
+		op.Error(fmt.Errorf("source entry %q not found", name))
+		return false, syscall.ENOENT
+	}
+
+	dstMeta, dstVclock := srcMeta, srcVclock
+	dstChildren := srcChildren
+	if !sameDir {
+		dstMeta, dstVclock, err = gKVStore.Metadata(newInum)
+		if err != nil {
+			op.Error(fmt.Errorf("getting destination dir metadata: %v", err))
+			return false, syscall.EIO
+		}
+		dstChildren, err = childEntries(newInum, dstMeta)
+		if err != nil {
+			op.Error(err)
+			return false, syscall.EIO
+		}
+	}
+	dstEntry := findChildEntry(dstChildren, newName)
+
+	now := time.Now().UnixNano()
+
+	if exchange {
+		if dstEntry == nil {
+			op.Error(fmt.Errorf("destination entry %q not found for exchange", newName))
+			return false, syscall.ENOENT
+		}
+		if err := renameExchange(inum, newInum, srcEntry, dstEntry, sameDir, dentryMode, now); err != nil {
+			return true, 0
+		}
+		return false, 0
+	}
+
+	var orphanInum uint64
+	var orphanMeta *bangpb.InodeMeta
+	var orphanVclock []byte
+	haveOrphan := false
+	if dstEntry != nil {
+		if noReplace {
+			op.Error(fmt.Errorf("destination entry %q already exists", newName))
+			return false, syscall.EEXIST
+		}
+		dstTargetMeta, dstTargetVclock, err := gKVStore.Metadata(dstEntry.Inode)
+		if err != nil {
+			op.Error(fmt.Errorf("getting destination target metadata: %v", err))
+			return false, syscall.EIO
+		}
+		if IsDir(dstTargetMeta) {
+			dstTargetChildren, err := childEntries(dstEntry.Inode, dstTargetMeta)
+			if err != nil {
+				op.Error(err)
+				return false, syscall.EIO
+			}
+			if len(dstTargetChildren) > 0 {
+				op.Error(fmt.Errorf("destination entry %q is a non-empty directory", newName))
+				return false, syscall.ENOTEMPTY
+			}
+		} else if !IsFile(dstTargetMeta) {
+			op.Error(fmt.Errorf("destination entry %q is neither file nor directory", newName))
+			return false, syscall.ENOTSUP
+		}
+		orphanInum, orphanMeta, orphanVclock, haveOrphan = dstEntry.Inode, dstTargetMeta, dstTargetVclock, true
+	}
+
+	if err := renameMove(inum, newInum, srcEntry, name, newName, sameDir, dentryMode, now); err != nil {
+		return true, 0
+	}
+
+	if haveOrphan {
+		orphanMeta.Nlink--
+		if _, err := gKVStore.UpdateMetadata(orphanInum, orphanMeta, orphanVclock); err != nil {
+			op.Error(fmt.Errorf("decrementing nlink on replaced entry: %v", err))
+		} else if err := finalizeIfOrphaned(orphanInum); err != nil {
+			op.Error(fmt.Errorf("finalizing replaced entry: %v", err))
+		}
+	}
+
+	return false, 0
+}
+
+// renameMove performs the actual entry move from (srcParent, name) to
+// (dstParent, newName), updating the moved child's ParentInode when it
+// crosses directories, and returns a non-nil error if any CAS write lost a
+// race (the caller retries the whole attempt in that case).
+func renameMove(srcParent, dstParent uint64, srcEntry *bangpb.ChildEntry, name, newName string, sameDir, dentryMode bool, now int64) error {
+	movedInum := srcEntry.Inode
+	movedMeta, movedVclock, err := gKVStore.Metadata(movedInum)
+	if err != nil {
+		return fmt.Errorf("getting moved child metadata: %w", err)
+	}
+	movingDir := IsDir(movedMeta)
+
+	if dentryMode {
+		if err := gKVStore.PutDentry(dstParent, &bangpb.ChildEntry{Name: newName, Inode: movedInum, Mode: movedMeta.Mode}); err != nil {
+			return fmt.Errorf("storing destination dentry: %w", err)
+		}
+		if !sameDir || name != newName {
+			if err := gKVStore.DeleteDentry(srcParent, name); err != nil {
+				return fmt.Errorf("deleting source dentry: %w", err)
+			}
+		}
+		if sameDir {
+			if err := touchDir(srcParent, 0, now); err != nil {
+				return err
+			}
+		} else {
+			srcDelta, dstDelta := int32(0), int32(0)
+			if movingDir {
+				srcDelta, dstDelta = -1, 1
+			}
+			if err := touchDir(srcParent, srcDelta, now); err != nil {
+				return err
+			}
+			if err := touchDir(dstParent, dstDelta, now); err != nil {
+				return err
+			}
+		}
+	} else {
+		srcMeta, srcVclock, err := gKVStore.Metadata(srcParent)
+		if err != nil {
+			return fmt.Errorf("getting source dir metadata: %w", err)
+		}
+		srcMeta.ChildEntries = withoutChildEntry(srcMeta.GetChildEntries(), name)
+		srcMeta.MtimeNs = now
+		srcMeta.CtimeNs = now
+		if sameDir {
+			srcMeta.ChildEntries = withoutChildEntry(srcMeta.ChildEntries, newName)
+			srcMeta.ChildEntries = append(srcMeta.ChildEntries, &bangpb.ChildEntry{Name: newName, Inode: movedInum, Mode: movedMeta.Mode})
+			if _, err := gKVStore.UpdateMetadata(srcParent, srcMeta, srcVclock); err != nil {
+				return fmt.Errorf("updating source dir metadata: %w", err)
+			}
+		} else {
+			if movingDir {
+				srcMeta.Nlink--
+			}
+			if _, err := gKVStore.UpdateMetadata(srcParent, srcMeta, srcVclock); err != nil {
+				return fmt.Errorf("updating source dir metadata: %w", err)
+			}
+			dstMeta, dstVclock, err := gKVStore.Metadata(dstParent)
+			if err != nil {
+				return fmt.Errorf("getting destination dir metadata: %w", err)
+			}
+			dstMeta.ChildEntries = withoutChildEntry(dstMeta.GetChildEntries(), newName)
+			dstMeta.ChildEntries = append(dstMeta.ChildEntries, &bangpb.ChildEntry{Name: newName, Inode: movedInum, Mode: movedMeta.Mode})
+			dstMeta.MtimeNs = now
+			dstMeta.CtimeNs = now
+			if movingDir {
+				dstMeta.Nlink++
+			}
+			if _, err := gKVStore.UpdateMetadata(dstParent, dstMeta, dstVclock); err != nil {
+				return fmt.Errorf("updating destination dir metadata: %w", err)
+			}
+		}
+	}
+
+	if !sameDir {
+		movedMeta.ParentInode = dstParent
+		movedMeta.Name = newName
+		movedMeta.CtimeNs = now
+		if _, err := gKVStore.UpdateMetadata(movedInum, movedMeta, movedVclock); err != nil {
+			return fmt.Errorf("updating moved child metadata: %w", err)
+		}
+	} else if name != newName {
+		movedMeta.Name = newName
+		movedMeta.CtimeNs = now
+		if _, err := gKVStore.UpdateMetadata(movedInum, movedMeta, movedVclock); err != nil {
+			return fmt.Errorf("updating moved child metadata: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// renameExchange swaps the two entries in place: name keeps living under
+// srcParent and newName under dstParent, but the inodes they point at (and,
+// for directories, ParentInode/Nlink bookkeeping) are swapped.
+func renameExchange(srcParent, dstParent uint64, srcEntry, dstEntry *bangpb.ChildEntry, sameDir, dentryMode bool, now int64) error {
+	srcInum, dstInum := srcEntry.Inode, dstEntry.Inode
+
+	srcChildMeta, srcChildVclock, err := gKVStore.Metadata(srcInum)
+	if err != nil {
+		return fmt.Errorf("getting source child metadata: %w", err)
+	}
+	dstChildMeta, dstChildVclock, err := gKVStore.Metadata(dstInum)
+	if err != nil {
+		return fmt.Errorf("getting destination child metadata: %w", err)
+	}
+
+	if dentryMode {
+		if err := gKVStore.PutDentry(srcParent, &bangpb.ChildEntry{Name: srcEntry.Name, Inode: dstInum, Mode: dstChildMeta.Mode}); err != nil {
+			return fmt.Errorf("storing swapped source dentry: %w", err)
+		}
+		if err := gKVStore.PutDentry(dstParent, &bangpb.ChildEntry{Name: dstEntry.Name, Inode: srcInum, Mode: srcChildMeta.Mode}); err != nil {
+			return fmt.Errorf("storing swapped destination dentry: %w", err)
+		}
+		if err := touchDir(srcParent, 0, now); err != nil {
+			return err
+		}
+		if !sameDir {
+			if err := touchDir(dstParent, 0, now); err != nil {
+				return err
+			}
+		}
+	} else {
+		srcMeta, srcVclock, err := gKVStore.Metadata(srcParent)
+		if err != nil {
+			return fmt.Errorf("getting source dir metadata: %w", err)
+		}
+		if e := findChildEntry(srcMeta.GetChildEntries(), srcEntry.Name); e != nil {
+			e.Inode = dstInum
+			e.Mode = dstChildMeta.Mode
+		}
+		if sameDir {
+			if e := findChildEntry(srcMeta.GetChildEntries(), dstEntry.Name); e != nil {
+				e.Inode = srcInum
+				e.Mode = srcChildMeta.Mode
+			}
+		}
+		srcMeta.MtimeNs = now
+		srcMeta.CtimeNs = now
+		if _, err := gKVStore.UpdateMetadata(srcParent, srcMeta, srcVclock); err != nil {
+			return fmt.Errorf("updating source dir metadata: %w", err)
+		}
+		if !sameDir {
+			dstMeta, dstVclock, err := gKVStore.Metadata(dstParent)
+			if err != nil {
+				return fmt.Errorf("getting destination dir metadata: %w", err)
+			}
+			if e := findChildEntry(dstMeta.GetChildEntries(), dstEntry.Name); e != nil {
+				e.Inode = srcInum
+				e.Mode = srcChildMeta.Mode
+			}
+			dstMeta.MtimeNs = now
+			dstMeta.CtimeNs = now
+			if _, err := gKVStore.UpdateMetadata(dstParent, dstMeta, dstVclock); err != nil {
+				return fmt.Errorf("updating destination dir metadata: %w", err)
+			}
+		}
+	}
+
+	if !sameDir {
+		srcChildMeta.ParentInode = dstParent
+		dstChildMeta.ParentInode = srcParent
+		srcChildMeta.CtimeNs = now
+		dstChildMeta.CtimeNs = now
+		if _, err := gKVStore.UpdateMetadata(srcInum, srcChildMeta, srcChildVclock); err != nil {
+			return fmt.Errorf("updating swapped source child metadata: %w", err)
+		}
+		if _, err := gKVStore.UpdateMetadata(dstInum, dstChildMeta, dstChildVclock); err != nil {
+			return fmt.Errorf("updating swapped destination child metadata: %w", err)
+		}
+	}
+
+	return nil
+}
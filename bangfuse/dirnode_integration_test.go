@@ -0,0 +1,129 @@
+//go:build integration
+
+// Integration tests driving rename/symlink/hardlink behavior through a real
+// BangFS mount — requires /dev/fuse and permission to mount FUSE
+// filesystems (CAP_SYS_ADMIN or user_allow_other).
+// Run: go test -tags=integration -v -run 'TestRename_|TestSymlink|TestHardlink' ./bangfuse/
+
+package bangfuse
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestRename_ReplaceAndExchange exercises os.Rename (replace) and the raw
+// RENAME_EXCHANGE syscall against a live mount, covering the path
+// TestRenameOnce_* unit-tests the retry/CAS plumbing for.
+func TestRename_ReplaceAndExchange(t *testing.T) {
+	mnt := mountPosixTestFS(t)
+
+	a := filepath.Join(mnt, "a")
+	b := filepath.Join(mnt, "b")
+	if err := os.WriteFile(a, []byte("A"), 0644); err != nil {
+		t.Fatalf("WriteFile a: %v", err)
+	}
+	if err := os.WriteFile(b, []byte("B"), 0644); err != nil {
+		t.Fatalf("WriteFile b: %v", err)
+	}
+
+	if err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE); err != nil {
+		t.Fatalf("renameat2 exchange: %v", err)
+	}
+	gotA, err := os.ReadFile(a)
+	if err != nil || string(gotA) != "B" {
+		t.Fatalf("after exchange, a = %q, %v, want %q", gotA, err, "B")
+	}
+	gotB, err := os.ReadFile(b)
+	if err != nil || string(gotB) != "A" {
+		t.Fatalf("after exchange, b = %q, %v, want %q", gotB, err, "A")
+	}
+
+	if err := os.Rename(a, b); err != nil {
+		t.Fatalf("Rename a -> b (replace): %v", err)
+	}
+	if _, err := os.Stat(a); !os.IsNotExist(err) {
+		t.Fatalf("source %q should be gone after replace, stat err = %v", a, err)
+	}
+	gotB, err = os.ReadFile(b)
+	if err != nil || string(gotB) != "B" {
+		t.Fatalf("after replace, b = %q, %v, want %q", gotB, err, "B")
+	}
+}
+
+// TestSymlink_CreateAndRead creates a symlink through the mount and reads
+// its target back.
+func TestSymlink_CreateAndRead(t *testing.T) {
+	mnt := mountPosixTestFS(t)
+
+	target := filepath.Join(mnt, "target")
+	if err := os.WriteFile(target, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile target: %v", err)
+	}
+	link := filepath.Join(mnt, "link")
+	if err := os.Symlink("target", link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	got, err := os.Readlink(link)
+	if err != nil || got != "target" {
+		t.Fatalf("Readlink(link) = %q, %v, want %q", got, err, "target")
+	}
+	data, err := os.ReadFile(link)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("ReadFile(link) = %q, %v, want %q", data, err, "hello")
+	}
+}
+
+// TestHardlink_NlinkAndOrphan creates a hardlink, checks Nlink is 2 on both
+// names, then unlinks one and confirms the file survives under the other
+// name before being finalized once the last link is removed.
+func TestHardlink_NlinkAndOrphan(t *testing.T) {
+	mnt := mountPosixTestFS(t)
+
+	a := filepath.Join(mnt, "a")
+	b := filepath.Join(mnt, "b")
+	if err := os.WriteFile(a, []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile a: %v", err)
+	}
+	if err := os.Link(a, b); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+
+	for _, p := range []string{a, b} {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			t.Fatalf("Lstat(%q): %v", p, err)
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || st.Nlink != 2 {
+			t.Fatalf("Lstat(%q).Nlink = %v, want 2", p, fi.Sys())
+		}
+	}
+
+	if err := os.Remove(a); err != nil {
+		t.Fatalf("Remove a: %v", err)
+	}
+	data, err := os.ReadFile(b)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("ReadFile(b) after removing a = %q, %v, want %q", data, err, "hello")
+	}
+	fi, err := os.Lstat(b)
+	if err != nil {
+		t.Fatalf("Lstat(b): %v", err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Nlink != 1 {
+		t.Fatalf("Lstat(b).Nlink = %d, want 1", st.Nlink)
+	}
+
+	if err := os.Remove(b); err != nil {
+		t.Fatalf("Remove b: %v", err)
+	}
+	if _, err := os.Stat(b); !os.IsNotExist(err) {
+		t.Fatalf("b should be gone after removing both links, stat err = %v", err)
+	}
+}
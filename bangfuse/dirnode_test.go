@@ -0,0 +1,284 @@
+package bangfuse
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+
+	"bangfs/bangutil"
+	bangpb "bangfs/proto"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// TestMutateDirMeta_ConcurrentWritersNoLostUpdates hammers the same parent
+// directory's ChildEntries with concurrent mutateDirMeta callers (the same
+// pattern Create/Mkdir/Rmdir/Unlink use) and checks every writer's entry
+// survived — the retry loop is what's supposed to stop a losing CAS from
+// silently dropping a concurrent writer's change.
+func TestMutateDirMeta_ConcurrentWritersNoLostUpdates(t *testing.T) {
+	kv := testFileKV(t)
+	prevKV := gKVStore
+	gKVStore = kv
+	t.Cleanup(func() { gKVStore = prevKV })
+
+	const dirInum = 1
+	if _, err := kv.PutMetadata(dirInum, &bangpb.InodeMeta{
+		Name:         "dir",
+		Mode:         0755,
+		ChildEntries: []*bangpb.ChildEntry{},
+	}); err != nil {
+		t.Fatalf("PutMetadata: %v", err)
+	}
+
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := childName(i)
+			errno := mutateDirMeta(dirInum, defaultMutateDirMetaAttempts, func(dm *bangpb.InodeMeta) syscall.Errno {
+				dm.ChildEntries = append(dm.ChildEntries, &bangpb.ChildEntry{Name: name, Inode: uint64(i)})
+				return 0
+			})
+			if errno != 0 {
+				t.Errorf("mutateDirMeta for %q: errno %d", name, errno)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	meta, _, err := kv.Metadata(dirInum)
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	if got := len(meta.ChildEntries); got != writers {
+		t.Fatalf("got %d child entries, want %d (lost a concurrent write)", got, writers)
+	}
+	seen := make(map[string]bool, writers)
+	for _, c := range meta.ChildEntries {
+		if seen[c.Name] {
+			t.Errorf("duplicate child entry %q", c.Name)
+		}
+		seen[c.Name] = true
+	}
+}
+
+func childName(i int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	return "child_" + string(letters[i%len(letters)]) + string(letters[(i/len(letters))%len(letters)])
+}
+
+// setupRenameTest installs a fresh FileKVStore as gKVStore (non-dentry
+// mode, the embedded-ChildEntries branch renameOnce/renameExchange took
+// the reported data-loss bug in) and restores the previous gKVStore on
+// cleanup.
+func setupRenameTest(t *testing.T) KVStore {
+	t.Helper()
+	kv := testFileKV(t)
+	prevKV := gKVStore
+	gKVStore = kv
+	t.Cleanup(func() { gKVStore = prevKV })
+	return kv
+}
+
+// putDir stores a directory's metadata with the given children under inum.
+func putDir(t *testing.T, kv KVStore, inum uint64, children []*bangpb.ChildEntry) {
+	t.Helper()
+	if _, err := kv.PutMetadata(inum, &bangpb.InodeMeta{
+		Mode:         syscall.S_IFDIR | 0755,
+		Nlink:        1,
+		ChildEntries: children,
+	}); err != nil {
+		t.Fatalf("PutMetadata(dir %d): %v", inum, err)
+	}
+}
+
+// putFile stores a regular file's metadata under inum, with parent as its
+// ParentInode.
+func putFile(t *testing.T, kv KVStore, inum, parent uint64) {
+	t.Helper()
+	if _, err := kv.PutMetadata(inum, &bangpb.InodeMeta{
+		Mode:        syscall.S_IFREG | 0644,
+		Nlink:       1,
+		ParentInode: parent,
+	}); err != nil {
+		t.Fatalf("PutMetadata(file %d): %v", inum, err)
+	}
+}
+
+func renameOp(name string) *bangutil.TraceOp {
+	return bangutil.GetTracer().Op("Rename", 0, name)
+}
+
+// TestRenameOnce_CrossDir moves a file from one directory to another and
+// checks the source entry is gone, the destination entry appears pointing
+// at the same inode, and the moved file's ParentInode/Name follow it.
+func TestRenameOnce_CrossDir(t *testing.T) {
+	kv := setupRenameTest(t)
+
+	const srcDir, dstDir, fileInum = 1, 2, 10
+	putFile(t, kv, fileInum, srcDir)
+	putDir(t, kv, srcDir, []*bangpb.ChildEntry{{Name: "a", Inode: fileInum, Mode: syscall.S_IFREG}})
+	putDir(t, kv, dstDir, nil)
+
+	retry, errno := renameOnce(srcDir, "a", dstDir, "b", 0, renameOp("a"))
+	if retry || errno != 0 {
+		t.Fatalf("renameOnce: retry=%v errno=%v", retry, errno)
+	}
+
+	srcMeta, _, _ := kv.Metadata(srcDir)
+	if findChildEntry(srcMeta.GetChildEntries(), "a") != nil {
+		t.Fatalf("source entry %q still present after cross-dir move", "a")
+	}
+	dstMeta, _, _ := kv.Metadata(dstDir)
+	e := findChildEntry(dstMeta.GetChildEntries(), "b")
+	if e == nil || e.Inode != fileInum {
+		t.Fatalf("destination entry %q missing or wrong inode: %+v", "b", e)
+	}
+	fileMeta, _, _ := kv.Metadata(fileInum)
+	if fileMeta.ParentInode != dstDir || fileMeta.Name != "b" {
+		t.Fatalf("moved file metadata not updated: %+v", fileMeta)
+	}
+}
+
+// TestRenameOnce_SameDir renames a file within a single directory.
+func TestRenameOnce_SameDir(t *testing.T) {
+	kv := setupRenameTest(t)
+
+	const dir, fileInum = 1, 10
+	putFile(t, kv, fileInum, dir)
+	putDir(t, kv, dir, []*bangpb.ChildEntry{{Name: "a", Inode: fileInum, Mode: syscall.S_IFREG}})
+
+	retry, errno := renameOnce(dir, "a", dir, "b", 0, renameOp("a"))
+	if retry || errno != 0 {
+		t.Fatalf("renameOnce: retry=%v errno=%v", retry, errno)
+	}
+
+	meta, _, _ := kv.Metadata(dir)
+	if findChildEntry(meta.GetChildEntries(), "a") != nil {
+		t.Fatalf("old name %q still present after same-dir rename", "a")
+	}
+	e := findChildEntry(meta.GetChildEntries(), "b")
+	if e == nil || e.Inode != fileInum {
+		t.Fatalf("new name %q missing or wrong inode: %+v", "b", e)
+	}
+}
+
+// TestRenameOnce_Replace renames onto an existing destination entry,
+// checking the old destination's Nlink is decremented (and it's finalized,
+// since this test drops it to zero).
+func TestRenameOnce_Replace(t *testing.T) {
+	kv := setupRenameTest(t)
+
+	const dir, srcInum, dstInum = 1, 10, 11
+	putFile(t, kv, srcInum, dir)
+	putFile(t, kv, dstInum, dir)
+	putDir(t, kv, dir, []*bangpb.ChildEntry{
+		{Name: "a", Inode: srcInum, Mode: syscall.S_IFREG},
+		{Name: "b", Inode: dstInum, Mode: syscall.S_IFREG},
+	})
+
+	retry, errno := renameOnce(dir, "a", dir, "b", 0, renameOp("a"))
+	if retry || errno != 0 {
+		t.Fatalf("renameOnce: retry=%v errno=%v", retry, errno)
+	}
+
+	meta, _, _ := kv.Metadata(dir)
+	e := findChildEntry(meta.GetChildEntries(), "b")
+	if e == nil || e.Inode != srcInum {
+		t.Fatalf("replaced entry %q missing or wrong inode: %+v", "b", e)
+	}
+	if _, _, err := kv.Metadata(dstInum); err == nil {
+		t.Fatalf("replaced target %d should have been finalized (nlink 0), still present", dstInum)
+	}
+}
+
+// TestRenameOnce_NoReplace checks RENAME_NOREPLACE rejects a rename onto an
+// existing destination entry without touching either entry.
+func TestRenameOnce_NoReplace(t *testing.T) {
+	kv := setupRenameTest(t)
+
+	const dir, srcInum, dstInum = 1, 10, 11
+	putFile(t, kv, srcInum, dir)
+	putFile(t, kv, dstInum, dir)
+	putDir(t, kv, dir, []*bangpb.ChildEntry{
+		{Name: "a", Inode: srcInum, Mode: syscall.S_IFREG},
+		{Name: "b", Inode: dstInum, Mode: syscall.S_IFREG},
+	})
+
+	retry, errno := renameOnce(dir, "a", dir, "b", RENAME_NOREPLACE, renameOp("a"))
+	if retry || errno != syscall.EEXIST {
+		t.Fatalf("renameOnce with RENAME_NOREPLACE: retry=%v errno=%v, want EEXIST", retry, errno)
+	}
+
+	meta, _, _ := kv.Metadata(dir)
+	if e := findChildEntry(meta.GetChildEntries(), "a"); e == nil || e.Inode != srcInum {
+		t.Fatalf("source entry %q disturbed by rejected rename: %+v", "a", e)
+	}
+	if e := findChildEntry(meta.GetChildEntries(), "b"); e == nil || e.Inode != dstInum {
+		t.Fatalf("destination entry %q disturbed by rejected rename: %+v", "b", e)
+	}
+}
+
+// TestRenameOnce_Exchange_CrossDir swaps two entries living in different
+// directories and checks both inodes end up pointing at each other's old
+// slot, with neither dropped.
+func TestRenameOnce_Exchange_CrossDir(t *testing.T) {
+	kv := setupRenameTest(t)
+
+	const dirA, dirB, inumA, inumB = 1, 2, 10, 11
+	putFile(t, kv, inumA, dirA)
+	putFile(t, kv, inumB, dirB)
+	putDir(t, kv, dirA, []*bangpb.ChildEntry{{Name: "a", Inode: inumA, Mode: syscall.S_IFREG}})
+	putDir(t, kv, dirB, []*bangpb.ChildEntry{{Name: "b", Inode: inumB, Mode: syscall.S_IFREG}})
+
+	retry, errno := renameOnce(dirA, "a", dirB, "b", fs.RENAME_EXCHANGE, renameOp("a"))
+	if retry || errno != 0 {
+		t.Fatalf("renameOnce exchange: retry=%v errno=%v", retry, errno)
+	}
+
+	metaA, _, _ := kv.Metadata(dirA)
+	metaB, _, _ := kv.Metadata(dirB)
+	if e := findChildEntry(metaA.GetChildEntries(), "a"); e == nil || e.Inode != inumB {
+		t.Fatalf("dirA entry %q should now point at %d: %+v", "a", inumB, e)
+	}
+	if e := findChildEntry(metaB.GetChildEntries(), "b"); e == nil || e.Inode != inumA {
+		t.Fatalf("dirB entry %q should now point at %d: %+v", "b", inumA, e)
+	}
+}
+
+// TestRenameOnce_Exchange_SameDir swaps two entries in the same directory —
+// the case that used to only repoint one of the two names, orphaning the
+// other inode out of the directory entirely.
+func TestRenameOnce_Exchange_SameDir(t *testing.T) {
+	kv := setupRenameTest(t)
+
+	const dir, inumA, inumB = 1, 10, 11
+	putFile(t, kv, inumA, dir)
+	putFile(t, kv, inumB, dir)
+	putDir(t, kv, dir, []*bangpb.ChildEntry{
+		{Name: "a", Inode: inumA, Mode: syscall.S_IFREG},
+		{Name: "b", Inode: inumB, Mode: syscall.S_IFREG},
+	})
+
+	retry, errno := renameOnce(dir, "a", dir, "b", fs.RENAME_EXCHANGE, renameOp("a"))
+	if retry || errno != 0 {
+		t.Fatalf("renameOnce exchange: retry=%v errno=%v", retry, errno)
+	}
+
+	meta, _, _ := kv.Metadata(dir)
+	entries := meta.GetChildEntries()
+	if got := len(entries); got != 2 {
+		t.Fatalf("got %d child entries after same-dir exchange, want 2 (an inode was orphaned): %+v", got, entries)
+	}
+	ea := findChildEntry(entries, "a")
+	eb := findChildEntry(entries, "b")
+	if ea == nil || ea.Inode != inumB {
+		t.Fatalf("entry %q should now point at %d: %+v", "a", inumB, ea)
+	}
+	if eb == nil || eb.Inode != inumA {
+		t.Fatalf("entry %q should now point at %d: %+v", "b", inumA, eb)
+	}
+}
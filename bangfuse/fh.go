@@ -2,8 +2,10 @@ package bangfuse
 
 import (
 	"bangfs/bangutil"
+	"bytes"
 	"context"
 	"fmt"
+	"math"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -18,6 +20,8 @@ type BangFH struct {
 	Inum     uint64
 	Metadata *bangpb.InodeMeta
 	VClock   []byte
+	pages    *pageBuffer    // dirty chunk bytes not yet uploaded; see pagebuffer.go
+	prefetch *prefetchState // read-ahead window, in-flight tracking, chunk LRU; see prefetch.go
 }
 
 func (f *BangFH) String() string {
@@ -30,10 +34,80 @@ func (f *BangFH) String() string {
 
 var _ = (fs.FileWriter)((*BangFH)(nil))
 var _ = (fs.FileReader)((*BangFH)(nil))
+var _ = (fs.FileReleaser)((*BangFH)(nil))
+var _ = (fs.FileFlusher)((*BangFH)(nil))
+var _ = (fs.FileFsyncer)((*BangFH)(nil))
+var _ = (fs.FileAllocater)((*BangFH)(nil))
 
 //var _ = (fs.File)
 
-// replaceChunk replaces a chunk in the file with new data
+// Flush drains the dirty-page buffer, uploading any chunks modified since
+// the last flush and writing metadata once. Called on every close() of a
+// descriptor referring to this handle.
+func (f *BangFH) Flush(ctx context.Context) syscall.Errno {
+	if err := f.flush(ctx); err != nil {
+		return syscall.EIO
+	}
+	return 0
+}
+
+// Fsync drains the dirty-page buffer the same way Flush does; bangfs has no
+// separate durability tier between "uploaded to the KV store" and "fsync'd",
+// so the two hooks are equivalent here.
+func (f *BangFH) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	if err := f.flush(ctx); err != nil {
+		return syscall.EIO
+	}
+	return 0
+}
+
+// Release drains the dirty-page buffer before dropping the open-file cache
+// refcount, so data written through this handle is durable by the time the
+// last close() returns. If this was the last open handle on an inode that
+// Unlink already dropped to Nlink 0, this is also what finally deletes its
+// chunks and metadata (see finalizeIfOrphaned).
+func (f *BangFH) Release(ctx context.Context) syscall.Errno {
+	errno := syscall.Errno(0)
+	if err := f.flush(ctx); err != nil {
+		errno = syscall.EIO
+	}
+	gOpenCache.Release(f.Inum)
+	gOpenHandles.Release(f.Inum)
+
+	if err := finalizeIfOrphaned(f.Inum); err != nil {
+		bangutil.GetTracer().Op("Release", f.Inum, f.Metadata.Name).Error(err)
+		errno = syscall.EIO
+	}
+	return errno
+}
+
+// Allocate preallocates space by extending the file with a hole ChunkRef;
+// no bytes are written to the KV store. Only mode 0 (grow Size, matching
+// plain fallocate()) is supported — FALLOC_FL_KEEP_SIZE, punch-hole, etc.
+// aren't implemented yet.
+func (f *BangFH) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
+	if mode != 0 {
+		return syscall.ENOTSUP
+	}
+	op := bangutil.GetTracer().Op("Allocate", f.Inum, f.Metadata.Name)
+
+	end := off + size
+	if end > f.Metadata.Size {
+		f.Metadata.Chunks = appendHoleChunks(f.Metadata.Chunks, end-f.Metadata.Size)
+		f.Metadata.Size = end
+	}
+
+	if err := f.writeMeta(ctx); err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
+	op.Done()
+	return 0
+}
+
+// replaceChunk replaces a chunk in the file with new data. The bytes are
+// staged in f.pages rather than uploaded immediately; flush() uploads them
+// and writes metadata once the dirty buffer is drained.
 func (f *BangFH) replaceChunk(ctx context.Context, idx int, data []byte) error {
 	op := bangutil.GetTracer().Op("replaceChunk", f.Inum, f.Metadata.Name)
 
@@ -44,23 +118,33 @@ func (f *BangFH) replaceChunk(ctx context.Context, idx int, data []byte) error {
 		return syscall.EIO
 	}
 
-	key := gChunkidgen.NextId()
-	err := gKVStore.PutChunk(key, data)
-	if err != nil {
-		op.Error(err)
-		return err
-	}
-
-	chks[idx].Hash = key
-	chks[idx].Size = uint32(len(data))
+	ref := chks[idx]
+	oldHash := ref.Hash
+	digest := bangutil.HashChunk(data)
+	ref.Hash = bangutil.ChunkKey(digest)
+	ref.Digest = digest
+	ref.Size = uint32(len(data))
+	f.pages.stage(ref, data, oldHash, true)
 
-	f.Metadata.Chunks = chks
 	op.Done()
 	return nil
 }
 
-// readChunk returns the content of a chunk at index idx
-func (f *BangFH) readChunk(ctx context.Context, idx int) ([]byte, error) {
+// readChunk returns the content of a chunk at index idx. Hole chunks are
+// materialised as zeros without any KV round-trip, chunks with bytes staged
+// in f.pages (written but not yet flushed) are served from there, and
+// anything already sitting in f.prefetch's cache (from read-ahead, or from
+// an earlier readChunk on this same handle) is served from there too —
+// this is what lets writeAt's read-modify-write path reuse prefetched data.
+// readChunk returns chunk idx's bytes. start and end bound the sub-range
+// within the chunk the caller actually needs (chunk-relative, end
+// exclusive); a non-hole chunk is always returned in full regardless of
+// start/end, since callers either need the whole buffer (writeAt, to merge
+// an overwrite into it) or slice it themselves afterwards (Read). A hole,
+// however, is materialized on demand — a hole's Size can be as large as
+// math.MaxUint32, so only the requested sub-range is allocated and
+// zero-filled rather than the whole span.
+func (f *BangFH) readChunk(ctx context.Context, idx int, start, end int64) ([]byte, error) {
 	op := bangutil.GetTracer().Op("BangFH.readChunk", f.Inum, f.Metadata.Name)
 
 	chks := f.Metadata.Chunks
@@ -69,31 +153,49 @@ func (f *BangFH) readChunk(ctx context.Context, idx int) ([]byte, error) {
 		op.Error(err)
 		return nil, err
 	}
+	if chks[idx].Hole {
+		op.Done()
+		return make([]byte, end-start), nil
+	}
+	if data, ok := f.pages.lookup(chks[idx]); ok {
+		op.Done()
+		return data, nil
+	}
+	if data, ok := f.prefetch.cache.get(chks[idx].Hash); ok {
+		bangutil.GetTracer().RecordKVOp("PrefetchHit", 0, len(data), 0, nil)
+		op.Done()
+		return data, nil
+	}
+	bangutil.GetTracer().RecordKVOp("PrefetchMiss", 0, 0, 0, nil)
 	key := chks[idx].Hash
 	data, err := gKVStore.Chunk(key)
 	if err != nil {
 		op.Error(err)
 		return nil, err
 	}
+	// ChunkKey truncates the content hash to 64 bits to use as the backend
+	// lookup key, so two unrelated chunks can in principle collide on that
+	// key; Digest is the full hash, so a mismatch here means we got back
+	// the wrong chunk rather than silently returning someone else's bytes.
+	if len(chks[idx].Digest) > 0 && !bytes.Equal(bangutil.HashChunk(data), chks[idx].Digest) {
+		err := fmt.Errorf("chunk %016x: content hash mismatch (key collision?)", key)
+		op.Error(err)
+		return nil, err
+	}
+	f.prefetch.cache.put(key, data)
 	op.Done()
 	return data, nil
 }
 
-// appendChunk appends a new chunk to the file but defers writing metadata
+// appendChunk appends a new chunk to the file, staging its bytes in f.pages
+// rather than uploading them immediately.
 func (f *BangFH) appendChunk(ctx context.Context, data []byte) error {
 	op := bangutil.GetTracer().Op("appendChunk", f.Inum, f.Metadata.Name)
 
-	chunkrefs := f.Metadata.Chunks
-
-	key := gChunkidgen.NextId()
-	err := gKVStore.PutChunk(key, data)
-	if err != nil {
-		op.Error(err)
-		return err
-	}
-	// TODO: decide if to undo the metadata or resync it if this fails
-	chunkrefs = append(chunkrefs, &bangpb.ChunkRef{Hash: key, Size: uint32(len(data))})
-	f.Metadata.Chunks = chunkrefs
+	digest := bangutil.HashChunk(data)
+	ref := &bangpb.ChunkRef{Hash: bangutil.ChunkKey(digest), Digest: digest, Size: uint32(len(data))}
+	f.Metadata.Chunks = append(f.Metadata.Chunks, ref)
+	f.pages.stage(ref, data, 0, false)
 
 	op.Done()
 	return nil
@@ -107,16 +209,34 @@ func (f *BangFH) writeMeta(ctx context.Context) error {
 	new_vclock, err := gKVStore.UpdateMetadata(f.Inum, f.Metadata, f.VClock)
 	if err != nil {
 		op.Error(err)
-		// Don't reload the vclock, since our metadata is still stale
+		// Our cached copy (if any) is superseded by the update that beat us; evict it.
+		gOpenCache.Invalidate(f.Inum)
 		return err
 	}
 
 	f.VClock = new_vclock // Our metadata should be in sync with what was written
+	gOpenCache.Update(f.Inum, f.Metadata, new_vclock)
 	op.Debugf("Metadata updated for inode %d, new vclcok: %v", f.Inum, f.VClock)
 	op.Done()
 	return nil
 }
 
+// syncMetadataFromCache refreshes f.Metadata/f.VClock from gOpenCache if our
+// copy is stale relative to it, eliminating the per-Write KV round trip
+// resyncMetadata used to make on every call. It falls back to resyncMetadata
+// on a cache miss (disabled cache, or inode not currently open).
+func (f *BangFH) syncMetadataFromCache(ctx context.Context) error {
+	cached, vclock, ok := gOpenCache.Get(f.Inum)
+	if !ok {
+		return f.resyncMetadata(ctx)
+	}
+	if string(vclock) != string(f.VClock) {
+		f.Metadata = cached
+		f.VClock = vclock
+	}
+	return nil
+}
+
 // resyncMetadata rereads the metadata in case of concurrent modification
 func (f *BangFH) resyncMetadata(ctx context.Context) error {
 	op := bangutil.GetTracer().Op("resyncMetadata", f.Inum, f.Metadata.Name)
@@ -135,22 +255,96 @@ func (f *BangFH) resyncMetadata(ctx context.Context) error {
 	return nil
 }
 
+// locateChunk walks chks (whose sizes need not be uniform once hole chunks
+// are present) and returns the index of the chunk containing file offset
+// pos, plus that chunk's starting offset. If pos is at or past the end of
+// the last chunk, it returns idx == len(chks).
+func locateChunk(chks []*bangpb.ChunkRef, pos int64) (idx int, chunkStart int64) {
+	var cum int64
+	for i, c := range chks {
+		if pos < cum+int64(c.Size) {
+			return i, cum
+		}
+		cum += int64(c.Size)
+	}
+	return len(chks), cum
+}
+
+// appendHoleChunks appends one or more hole ChunkRefs spanning gap bytes,
+// splitting into multiple refs rather than a single one because ChunkRef.Size
+// is a uint32: a single sparse region of 4GiB or more (e.g. `truncate -s 10G`)
+// would silently wrap if stuffed into one ref. Each ref but the last is
+// exactly math.MaxUint32 bytes.
+func appendHoleChunks(chunks []*bangpb.ChunkRef, gap uint64) []*bangpb.ChunkRef {
+	for gap > 0 {
+		sz := gap
+		if sz > math.MaxUint32 {
+			sz = math.MaxUint32
+		}
+		chunks = append(chunks, &bangpb.ChunkRef{Size: uint32(sz), Hole: true})
+		gap -= sz
+	}
+	return chunks
+}
+
+// splitHole carves a write into the hole chunk at idx (which spans
+// [holeStart, holeStart+chk.Size)), allocating a real chunk only for the
+// written bytes and leaving up to two smaller hole chunks on either side.
+// Returns the number of bytes of data consumed (bounded by the hole).
+func (f *BangFH) splitHole(ctx context.Context, idx int, holeStart int64, pos int64, data []byte) (int, error) {
+	chk := f.Metadata.Chunks[idx]
+	holeEnd := holeStart + int64(chk.Size)
+
+	n := len(data)
+	if pos+int64(n) > holeEnd {
+		n = int(holeEnd - pos)
+	}
+
+	digest := bangutil.HashChunk(data[:n])
+	real := &bangpb.ChunkRef{Hash: bangutil.ChunkKey(digest), Digest: digest, Size: uint32(n)}
+	f.pages.stage(real, data[:n], 0, false)
+
+	var replacement []*bangpb.ChunkRef
+	if pos > holeStart {
+		replacement = append(replacement, &bangpb.ChunkRef{Size: uint32(pos - holeStart), Hole: true})
+	}
+	replacement = append(replacement, real)
+	if pos+int64(n) < holeEnd {
+		replacement = append(replacement, &bangpb.ChunkRef{Size: uint32(holeEnd - pos - int64(n)), Hole: true})
+	}
+
+	chks := f.Metadata.Chunks
+	merged := make([]*bangpb.ChunkRef, 0, len(chks)-1+len(replacement))
+	merged = append(merged, chks[:idx]...)
+	merged = append(merged, replacement...)
+	merged = append(merged, chks[idx+1:]...)
+	f.Metadata.Chunks = merged
+
+	return n, nil
+}
+
 // writeAt splices data into the file at the given offset, modifying existing
-// chunks and appending new ones as needed.
-// All chunks except the last are exactly gChunksize bytes, so we use division
-// to index directly instead of walking.
+// chunks, splitting holes, and appending new chunks as needed.
 func (f *BangFH) writeAt(ctx context.Context, op *bangutil.TraceOp, data []byte, off int64) syscall.Errno {
-	chks := f.Metadata.Chunks
 	pos := off    // current file position
 	data_pos := 0 // how far into data we've consumed
 
 	for data_pos < len(data) {
-		chunk_idx := int(pos / int64(gChunksize))
-		offset_in_chunk := int(pos % int64(gChunksize))
+		chunk_idx, chunk_start := locateChunk(f.Metadata.Chunks, pos)
+		chks := f.Metadata.Chunks
 
-		if chunk_idx < len(chks) {
-			// Overwrite within an existing chunk
-			existing, err := f.readChunk(ctx, chunk_idx)
+		if chunk_idx < len(chks) && chks[chunk_idx].Hole {
+			n, err := f.splitHole(ctx, chunk_idx, chunk_start, pos, data[data_pos:])
+			if err != nil {
+				op.Errorf("splitHole[%d]: %v", chunk_idx, err)
+				return syscall.EIO
+			}
+			data_pos += n
+			pos += int64(n)
+		} else if chunk_idx < len(chks) {
+			// Overwrite within an existing (non-hole) chunk
+			offset_in_chunk := int(pos - chunk_start)
+			existing, err := f.readChunk(ctx, chunk_idx, 0, int64(chks[chunk_idx].Size))
 			if err != nil {
 				op.Errorf("readChunk[%d]: %v", chunk_idx, err)
 				return syscall.EIO
@@ -179,8 +373,6 @@ func (f *BangFH) writeAt(ctx context.Context, op *bangutil.TraceOp, data []byte,
 			}
 			data_pos += int(n)
 			pos += int64(n)
-			// appendChunk updates f.Metadata.Chunks, refresh local ref
-			chks = f.Metadata.Chunks
 		}
 	}
 
@@ -193,11 +385,16 @@ func (f *BangFH) Write(ctx context.Context, data []byte, off int64) (uint32, sys
 	op := bangutil.GetTracer().Op("Write", f.Inum, f.Metadata.Name)
 	op.Debugf("Write %d bytes at offset %d to inode %d", len(data), off, f.Inum)
 
-	// Re-read metadata: Setattr (e.g. O_TRUNC truncate) may have changed it.
-	// TODO: to save an extra read call we can track filehandles in the BangFile struct.
-	if err := f.resyncMetadata(ctx); err != nil {
-		op.Error(fmt.Errorf("resyncMetadata: %v", err))
-		return 0, syscall.EIO
+	// Setattr (e.g. O_TRUNC truncate) may have changed the metadata since we
+	// last saw it. Skipped entirely while pages are dirty — reloading would
+	// replace f.Metadata (and thus the ChunkRef pointers f.pages is keyed
+	// on) out from under buffered-but-not-yet-flushed writes; the next
+	// flush's writeMeta will detect a real conflict via the vclock anyway.
+	if f.pages.empty() {
+		if err := f.syncMetadataFromCache(ctx); err != nil {
+			op.Error(fmt.Errorf("syncMetadataFromCache: %v", err))
+			return 0, syscall.EIO
+		}
 	}
 
 	filesize := int64(f.Metadata.Size)
@@ -210,12 +407,13 @@ func (f *BangFH) Write(ctx context.Context, data []byte, off int64) (uint32, sys
 
 	write_end := off + int64(len(data))
 
-	// If writing past EOF, zero-fill the gap
+	// If writing past EOF, punch a hole over the gap instead of materialising
+	// it as real zero-filled chunks: "truncate -s 10G foo; echo hi >> foo"
+	// should cost one small chunk plus a hole ChunkRef, not 10GB of writes.
+	// writeAt's splitHole carves a real chunk out of this hole once `data`
+	// actually lands inside it.
 	if off > filesize {
-		gap := make([]byte, off-filesize)
-		if errno := f.writeAt(ctx, op, gap, filesize); errno != 0 {
-			return 0, errno
-		}
+		f.Metadata.Chunks = appendHoleChunks(f.Metadata.Chunks, uint64(off-filesize))
 		filesize = off
 	}
 
@@ -228,9 +426,17 @@ func (f *BangFH) Write(ctx context.Context, data []byte, off int64) (uint32, sys
 		f.Metadata.Size = uint64(write_end)
 	}
 
-	if err := f.writeMeta(ctx); err != nil {
-		op.Error(fmt.Errorf("syncing metadata (chunks and size): %v", err))
-		return 0, syscall.EIO
+	// The chunk bytes themselves are only staged in f.pages at this point
+	// (see replaceChunk/appendChunk/splitHole); make the size/chunk-ref
+	// change visible to Getattr on this inode right away even though it
+	// isn't durable until Flush/Fsync/Release drains the buffer.
+	gOpenCache.Update(f.Inum, f.Metadata, f.VClock)
+
+	if f.pages.size() >= maxBufferedBytes {
+		if err := f.flush(ctx); err != nil {
+			op.Error(fmt.Errorf("auto-flush at %d buffered bytes: %v", maxBufferedBytes, err))
+			return 0, syscall.EIO
+		}
 	}
 
 	op.Debugf("Wrote %d bytes at offset %d (new size: %d)", len(data), off, f.Metadata.Size)
@@ -261,6 +467,7 @@ func (f *BangFH) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadRes
 
 	// Walk chunks, accumulating an offset to find which chunks overlap [off, end)
 	var chunk_offset int64
+	lastIdx := -1
 	for i, chk := range chks {
 		chunk_end := chunk_offset + int64(chk.Size)
 
@@ -274,13 +481,6 @@ func (f *BangFH) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadRes
 			break
 		}
 
-		// This chunk overlaps the read window — fetch it
-		data, err := f.readChunk(ctx, i)
-		if err != nil {
-			op.Errorf("readChunk[%d]: %v", i, err)
-			return nil, syscall.EIO
-		}
-
 		// Slice within this chunk that overlaps the read window
 		slice_start := int64(0)
 		if off > chunk_offset {
@@ -291,8 +491,32 @@ func (f *BangFH) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadRes
 			slice_end = end - chunk_offset
 		}
 
-		buf = append(buf, data[slice_start:slice_end]...)
+		// This chunk overlaps the read window — fetch it. For a hole, only
+		// the [slice_start, slice_end) sub-range actually needed is
+		// allocated; for a real chunk the full buffer comes back and we
+		// still slice it below.
+		data, err := f.readChunk(ctx, i, slice_start, slice_end)
+		if err != nil {
+			op.Errorf("readChunk[%d]: %v", i, err)
+			return nil, syscall.EIO
+		}
+
+		if chk.Hole {
+			buf = append(buf, data...)
+		} else {
+			buf = append(buf, data[slice_start:slice_end]...)
+		}
 		chunk_offset = chunk_end
+		lastIdx = i
+	}
+
+	// Read-ahead: a Read whose offset picks up exactly where the previous
+	// one on this handle left off is treated as sequential access, and
+	// widens the prefetch window each time it repeats (capped at
+	// maxPrefetchWindow); anything else resets the window, so a workload
+	// that turns out to be random stops paying for chunks it never uses.
+	if sequential, window := f.prefetch.observe(off, end); sequential && lastIdx >= 0 {
+		f.prefetchAhead(lastIdx+1, window)
 	}
 
 	op.Debugf("Read returning %d bytes", len(buf))
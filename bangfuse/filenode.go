@@ -2,6 +2,7 @@ package bangfuse
 
 import (
 	"bangfs/bangutil"
+	bangpb "bangfs/proto"
 	"context"
 	"fmt"
 	"strings"
@@ -50,20 +51,32 @@ type BangFileNode struct {
 	fs.Inode
 }
 
+// storageClassXattr is the xattr used to read/set an inode's storage class
+// (InodeMeta.StorageClass), routed by TieredKVStore.
+const storageClassXattr = "user.bangfs.class"
+
 // Verify interface compliance
 var _ = (fs.NodeGetattrer)((*BangFileNode)(nil))
 var _ = (fs.NodeSetattrer)((*BangFileNode)(nil))
 var _ = (fs.NodeOpener)((*BangFileNode)(nil))
+var _ = (fs.NodeSetxattrer)((*BangFileNode)(nil))
+var _ = (fs.NodeGetxattrer)((*BangFileNode)(nil))
 
 // GetAttr returns the attributes of a file or directory
 func (bf *BangFileNode) Getattr(ctx context.Context, _ fs.FileHandle, out_attr *fuse.AttrOut) syscall.Errno {
 	inum := bf.Inode.StableAttr().Ino
 	op := bangutil.GetTracer().Op("Getattr", inum, "")
 
-	meta, _, err := kv.Metadata(inum)
-	if err != nil {
-		op.Error(err)
-		return syscall.EIO
+	var meta *bangpb.InodeMeta
+	if cached, _, ok := gOpenCache.Get(inum); ok {
+		meta = cached
+	} else {
+		m, _, err := gKVStore.Metadata(inum)
+		if err != nil {
+			op.Error(err)
+			return syscall.EIO
+		}
+		meta = m
 	}
 	op.SetName(meta.Name)
 
@@ -78,7 +91,7 @@ func (bf *BangFileNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.
 	op := bangutil.GetTracer().Op(fmt.Sprintf("Setattr (%v) (fh: %v)", debugSetAttrIn(in), fh), inum, "")
 
 	// Read the backend metadata
-	meta, fvclock, err := kv.Metadata(inum)
+	meta, fvclock, err := gKVStore.Metadata(inum)
 	if err != nil {
 		op.Error(err)
 		return syscall.EIO
@@ -106,54 +119,70 @@ func (bf *BangFileNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.
 		}
 		op.Debugf("truncate to size: %d (was %d)", sz, meta.Size)
 		if sz > meta.Size {
-			// Extending file not supported yet
-			op.Debug("extending not supported")
-			return syscall.ENOTSUP
-		}
-		chkrefs := meta.Chunks
-		// Walk chunks to find which chunk contains the new EOF
-		var cumsz uint64
-		keep := 0
-		for keep < len(chkrefs) {
-			cumsz += uint64(chkrefs[keep].Size)
-			keep++
-			if cumsz >= sz {
-				break
+			// Grow the file by appending hole chunks (more than one only for
+			// a gap over math.MaxUint32 bytes, see appendHoleChunks)
+			// describing the gap as implicit zeros; no chunk key is allocated and no data
+			// is written to the KV store. Reads materialise the zeros on
+			// demand (see readChunk); writes into the hole split it (see
+			// writeAt).
+			gap := sz - meta.Size
+			meta.Chunks = appendHoleChunks(meta.Chunks, gap)
+			meta.Size = sz
+		} else {
+			chkrefs := meta.Chunks
+			// Walk chunks to find which chunk contains the new EOF
+			var cumsz uint64
+			keep := 0
+			for keep < len(chkrefs) {
+				cumsz += uint64(chkrefs[keep].Size)
+				keep++
+				if cumsz >= sz {
+					break
+				}
 			}
-		}
-		// Collect chunks beyond the new EOF for deferred deletion
-		for i := keep; i < len(chkrefs); i++ {
-			stale_chunk_keys = append(stale_chunk_keys, chkrefs[i].Hash)
-		}
-		// Truncate the last kept chunk if the new size falls mid-chunk
-		if sz == 0 {
-			meta.Chunks = nil
-		} else if keep > 0 {
-			meta.Chunks = chkrefs[:keep]
-			// The last kept chunk may need to be shortened
-			last_idx := keep - 1
-			chunk_end := cumsz
-			chunk_start := chunk_end - uint64(chkrefs[last_idx].Size)
-			new_chunk_size := uint32(sz - chunk_start)
-			if new_chunk_size < chkrefs[last_idx].Size {
-				// Read the chunk, truncate it, write it back
-				data, err := kv.Chunk(chkrefs[last_idx].Hash)
-				if err != nil {
-					op.Errorf("reading chunk %d for truncate: %v", last_idx, err)
-					return syscall.EIO
+			// Collect chunks beyond the new EOF for deferred deletion
+			for i := keep; i < len(chkrefs); i++ {
+				if !chkrefs[i].Hole {
+					stale_chunk_keys = append(stale_chunk_keys, chkrefs[i].Hash)
 				}
-				truncated := data[:new_chunk_size]
-				new_chunk_key := chunkidgen.NextId()
-				if err := kv.PutChunk(new_chunk_key, truncated); err != nil {
-					op.Errorf("writing truncated chunk: %v", err)
-					return syscall.EIO
+			}
+			// Truncate the last kept chunk if the new size falls mid-chunk
+			if sz == 0 {
+				meta.Chunks = nil
+			} else if keep > 0 {
+				meta.Chunks = chkrefs[:keep]
+				// The last kept chunk may need to be shortened
+				last_idx := keep - 1
+				chunk_end := cumsz
+				chunk_start := chunk_end - uint64(chkrefs[last_idx].Size)
+				new_chunk_size := uint32(sz - chunk_start)
+				if new_chunk_size < chkrefs[last_idx].Size {
+					if chkrefs[last_idx].Hole {
+						// Shrinking a hole is just shortening it — no KV I/O.
+						meta.Chunks[last_idx].Size = new_chunk_size
+					} else {
+						// Read the chunk, truncate it, write it back
+						data, err := gKVStore.Chunk(chkrefs[last_idx].Hash)
+						if err != nil {
+							op.Errorf("reading chunk %d for truncate: %v", last_idx, err)
+							return syscall.EIO
+						}
+						truncated := data[:new_chunk_size]
+						new_digest := bangutil.HashChunk(truncated)
+						new_chunk_key := bangutil.ChunkKey(new_digest)
+						if err := putChunkForClass(StorageClassOf(meta), new_chunk_key, truncated); err != nil {
+							op.Errorf("writing truncated chunk: %v", err)
+							return syscall.EIO
+						}
+						stale_chunk_keys = append(stale_chunk_keys, chkrefs[last_idx].Hash)
+						meta.Chunks[last_idx].Hash = new_chunk_key
+						meta.Chunks[last_idx].Digest = new_digest
+						meta.Chunks[last_idx].Size = new_chunk_size
+					}
 				}
-				stale_chunk_keys = append(stale_chunk_keys, chkrefs[last_idx].Hash)
-				meta.Chunks[last_idx].Hash = new_chunk_key
-				meta.Chunks[last_idx].Size = new_chunk_size
 			}
+			meta.Size = sz
 		}
-		meta.Size = sz
 	}
 	mode, setmode := in.GetMode()
 	if setmode {
@@ -171,16 +200,19 @@ func (bf *BangFileNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.
 
 	// Write the data back to the backend
 	// NOTE: on vclock conflict, the newly-written truncated chunk may be orphaned
-	_, err = kv.UpdateMetadata(inum, meta, fvclock)
+	newVclock, err := gKVStore.UpdateMetadata(inum, meta, fvclock)
 	if err != nil {
 		op.Error(err)
+		gOpenCache.Invalidate(inum) // our cached copy (if any) is now known-stale
 		return syscall.EIO
 	}
+	gOpenCache.Update(inum, meta, newVclock)
 
 	// Delete stale chunks only after metadata was successfully written
 	for _, key := range stale_chunk_keys {
-		if err := kv.DeleteChunk(key); err != nil {
-			op.Debugf("failed to delete stale chunk %d: %v", key, err)
+		if err := gKVStore.DeleteChunk(key); err != nil {
+			op.Debugf("failed to delete stale chunk %d, queuing for retry: %v", key, err)
+			gChunkGC.Enqueue(key)
 		}
 	}
 
@@ -198,7 +230,7 @@ func (bf *BangFileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle,
 	inum := bf.Inode.StableAttr().Ino
 	op := bangutil.GetTracer().Op("Open", inum, "")
 
-	meta, vclock, err := kv.Metadata(inum)
+	meta, vclock, err := gKVStore.Metadata(inum)
 	if err != nil {
 		op.Error(err)
 		return nil, 0, syscall.EIO
@@ -207,10 +239,65 @@ func (bf *BangFileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle,
 	// 	op.Debug("is a dir") // Just debugging
 	// }
 	op.SetName(meta.Name)
+	gOpenCache.Open(inum, meta, vclock)
+	gOpenHandles.Acquire(inum)
 
-	fh := &BangFH{Inum: inum, Metadata: meta, VClock: vclock, Flags: flags}
+	fh := &BangFH{Inum: inum, Metadata: meta, VClock: vclock, Flags: flags, pages: newPageBuffer(), prefetch: newPrefetchState()}
 	fuse_flags := 0 // TODO: set flags
+	if gOpenCache.Enabled() {
+		// The open-file cache is now the source of truth for this inode's
+		// metadata between Writes (see BangFH.Write), so it's safe to let
+		// the kernel cache page contents across opens too.
+		fuse_flags |= fuse.FOPEN_KEEP_CACHE
+	}
 
 	op.Done()
 	return fh, uint32(fuse_flags), 0
 }
+
+// Getxattr returns the inode's storage class via the user.bangfs.class
+// xattr; all other attrs are reported absent.
+func (bf *BangFileNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if attr != storageClassXattr {
+		return 0, syscall.ENODATA
+	}
+	inum := bf.Inode.StableAttr().Ino
+	meta, _, err := gKVStore.Metadata(inum)
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	class := StorageClassOf(meta)
+	if len(dest) < len(class) {
+		return uint32(len(class)), syscall.ERANGE
+	}
+	return uint32(copy(dest, class)), 0
+}
+
+// Setxattr sets the inode's storage class via the user.bangfs.class xattr,
+// which TieredKVStore later consults to route PutChunk/Chunk to the right
+// tier. The value is taken verbatim as the class name.
+func (bf *BangFileNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if attr != storageClassXattr {
+		return syscall.ENOTSUP
+	}
+	inum := bf.Inode.StableAttr().Ino
+	op := bangutil.GetTracer().Op("Setxattr", inum, string(data))
+
+	meta, vclock, err := gKVStore.Metadata(inum)
+	if err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
+	meta.StorageClass = string(data)
+
+	newVclock, err := gKVStore.UpdateMetadata(inum, meta, vclock)
+	if err != nil {
+		op.Error(err)
+		gOpenCache.Invalidate(inum)
+		return syscall.EIO
+	}
+	gOpenCache.Update(inum, meta, newVclock)
+
+	op.Done()
+	return 0
+}
@@ -2,60 +2,124 @@ package bangfuse
 
 import (
 	"bangfs/bangutil"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"fmt"
 	"os"
 	"sync"
 	"time"
 )
 
+// Snowflake-style 64-bit id layout: 41 bits of ms-since-moduleEpoch (good
+// for ~69 years), 10 bits of node id, 12 bits of per-millisecond sequence.
+// This replaces an earlier layout (13-bit raw unix-ms timestamp, 14-bit
+// unbounded sequence) that wrapped its timestamp field in ~8 seconds and
+// let an unbounded sequence counter overrun its slot, silently colliding
+// inode ids under sustained load.
 const (
-	TIME_BITS = 13
-	SEQ_BITS  = 14
+	timeBits = 41
+	nodeBits = 10
+	seqBits  = 12
+
+	nodeShift = seqBits
+	timeShift = seqBits + nodeBits
+
+	maxSeq  = (1 << seqBits) - 1
+	maxNode = (1 << nodeBits) - 1
 )
 
+// moduleEpoch is the fixed reference point ids are timestamped against
+// (2024-01-01T00:00:00Z), so the 41-bit timestamp field doesn't waste range
+// on the decades since the Unix epoch that bangfs predates.
+const moduleEpoch int64 = 1704067200000
+
+// IdGenerator issues Snowflake-style ids unique within a single node id.
+// Generators for different purposes are told apart by NewIdGenerator's
+// salt parameter, which is mixed into the node id. The filesystem creates
+// only an inode generator (gInumgen); chunk keys are derived from chunk
+// content (see bangutil.ChunkKey), not from an IdGenerator.
 type IdGenerator struct {
-	seq_no   uint64
-	local_id uint64
-	mut      sync.Mutex
+	nodeID uint64
+
+	mut    sync.Mutex
+	lastMs int64
+	seq    uint64
 }
 
-// NewIdGenerator initializes an InodeNumGenerator for the current process
-func NewIdGenerator() *IdGenerator {
+// NewIdGenerator creates an IdGenerator for the current process. salt
+// distinguishes independent generators (e.g. "inode" vs "chunk") that share
+// the same node id source. The node id is the low 10 bits of a hash of salt
+// and the client id, so two salts can still map to the same node id.
+func NewIdGenerator(salt string) *IdGenerator {
 	return &IdGenerator{
-		mut:      sync.Mutex{},
-		seq_no:   0,
-		local_id: uint64(os.Getpid()) ^ getClientID(),
+		nodeID: getClientID(salt) & maxNode,
 	}
 }
 
-// NextId increments the sequence number and returns an inode number based
-// on seq_no, current time in milliseconds since epoch, and current server id.
-// seq_no increments each time an inode num is generated. The task and server id
-// are hashed to save bits
-func (ig *IdGenerator) NextId() uint64 {
+// NextId returns the next id, spin-waiting if the per-ms sequence has been
+// exhausted until the clock ticks forward. It returns an error if the
+// system clock is observed to move backward, rather than risk issuing a
+// ms/sequence pair already handed out.
+func (ig *IdGenerator) NextId() (uint64, error) {
+	return ig.NextIdCtx(context.Background())
+}
 
-	// Read and write the seq no, using mutex in case multiple goroutines are trying to increment it at once.
+// NextIdCtx is NextId but aborts an in-progress spin-wait (waiting for the
+// next millisecond after the sequence space fills up) if ctx is cancelled.
+func (ig *IdGenerator) NextIdCtx(ctx context.Context) (uint64, error) {
 	ig.mut.Lock()
-	seq_no := ig.seq_no
-	ig.seq_no++
-	ig.mut.Unlock()
+	defer ig.mut.Unlock()
 
-	ms_since_epoch := time.Now().UnixMilli()
+	ms := time.Now().UnixMilli() - moduleEpoch
+	for {
+		if ms < ig.lastMs {
+			return 0, fmt.Errorf("clock moved backward by %dms, refusing to issue an id", ig.lastMs-ms)
+		}
+		if ms == ig.lastMs {
+			ig.seq = (ig.seq + 1) & maxSeq
+			if ig.seq == 0 {
+				// Sequence exhausted for this millisecond; spin until the
+				// clock ticks forward.
+				for ms == ig.lastMs {
+					select {
+					case <-ctx.Done():
+						return 0, ctx.Err()
+					default:
+					}
+					ms = time.Now().UnixMilli() - moduleEpoch
+				}
+				continue
+			}
+		} else {
+			ig.seq = 0
+		}
+		ig.lastMs = ms
+		break
+	}
 
-	return uint64(ms_since_epoch) | (seq_no << SEQ_BITS) | (ig.local_id << (TIME_BITS + SEQ_BITS))
+	id := (uint64(ms) << timeShift) | (ig.nodeID << nodeShift) | ig.seq
+	if id == 0 {
+		// Inode 0 is reserved for the filesystem root; this can only
+		// happen in moduleEpoch's very first millisecond with node id 0
+		// and sequence 0, so just bump past it.
+		id = 1
+	}
+	return id, nil
 }
 
 // =========================
 // utility func
 // =========================
-// getClientId returns a stable server identifier using the following priority:
+// getClientID returns a stable node identifier, salted by purpose (e.g.
+// "inode" vs "chunk") so two generators sharing a host never collide, using
+// the following priority:
 // 1. BANGFS_CLIENT_ID environment variable (explicit configuration)
 // 2. Hash of hostname (works for StatefulSets and regular servers)
 // 3. Fall back to random value
-func getClientID() uint64 {
+func getClientID(salt string) uint64 {
 	if server_id_str := os.Getenv("BANGFS_CLIENT_ID"); server_id_str != "" {
-		return bangutil.FNV64([]byte(server_id_str))
+		return bangutil.FNV64([]byte(salt + ":" + server_id_str))
 	}
 	hostname, err := os.Hostname()
 	if err != nil { // TODO: warn that there's no client id defined
@@ -63,5 +127,5 @@ func getClientID() uint64 {
 		rand.Read(b[:])
 		return binary.NativeEndian.Uint64(b[:])
 	}
-	return uint64(bangutil.FNV32([]byte(hostname)))
+	return bangutil.FNV64([]byte(salt + ":" + hostname))
 }
@@ -0,0 +1,74 @@
+package bangfuse
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIdGenerator_MonotonicAndUnique(t *testing.T) {
+	ig := NewIdGenerator("inode")
+	seen := make(map[uint64]bool)
+	var last uint64
+	for i := 0; i < 10000; i++ {
+		id, err := ig.NextId()
+		if err != nil {
+			t.Fatalf("NextId: %v", err)
+		}
+		if id == 0 {
+			t.Fatal("NextId returned 0, which is reserved for the root inode")
+		}
+		if seen[id] {
+			t.Fatalf("NextId returned a duplicate id %d", id)
+		}
+		seen[id] = true
+		if id <= last && i > 0 {
+			t.Fatalf("NextId not monotonic: %d followed %d", id, last)
+		}
+		last = id
+	}
+}
+
+func TestIdGenerator_DifferentSaltsNeverCollide(t *testing.T) {
+	inodeGen := NewIdGenerator("inode")
+	chunkGen := NewIdGenerator("chunk")
+	if inodeGen.nodeID == chunkGen.nodeID {
+		t.Fatal("expected different salts to produce different node ids")
+	}
+}
+
+func TestIdGenerator_SequenceOverflowSpinsToNextMs(t *testing.T) {
+	ig := NewIdGenerator("inode")
+	ig.lastMs = time.Now().UnixMilli() - moduleEpoch
+	ig.seq = maxSeq // next call must roll over into the next millisecond
+
+	id, err := ig.NextId()
+	if err != nil {
+		t.Fatalf("NextId: %v", err)
+	}
+	if id == 0 {
+		t.Fatal("unexpected zero id")
+	}
+}
+
+func TestIdGenerator_ClockMovedBackwardErrors(t *testing.T) {
+	ig := NewIdGenerator("inode")
+	ig.lastMs = time.Now().UnixMilli() - moduleEpoch + 60_000 // pretend we're a minute in the future
+
+	if _, err := ig.NextId(); err == nil {
+		t.Fatal("expected an error when the clock appears to have moved backward")
+	}
+}
+
+func TestIdGenerator_NextIdCtxRespectsCancellation(t *testing.T) {
+	ig := NewIdGenerator("inode")
+	ig.lastMs = time.Now().UnixMilli() - moduleEpoch
+	ig.seq = maxSeq
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := ig.NextIdCtx(ctx); err == nil {
+		t.Fatal("expected NextIdCtx to return an error once ctx is cancelled mid-spin")
+	}
+}
@@ -1,8 +1,15 @@
 package bangfuse
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -12,6 +19,47 @@ import (
 	bangpb "bangfs/proto"
 )
 
+// ErrVClockConflict is wrapped into the error returned by
+// UpdateMetadata/UpdateMetadataBytes when the write lost a CAS race against
+// a concurrent modification of the same inode — the vclock/version the
+// caller read no longer matches what's currently stored. Callers that want
+// to retry rather than surface EIO immediately should check for it with
+// errors.Is (see mutateDirMeta); anything else from UpdateMetadata is a
+// harder IO-level failure not worth retrying.
+var ErrVClockConflict = errors.New("vclock conflict: concurrent modification")
+
+func init() {
+	RegisterBackend("riak", func(dsn string) (KVStore, error) {
+		host, port, namespace, err := parseRiakDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return NewRiakKVStore(host, port, namespace)
+	})
+}
+
+// parseRiakDSN parses a "riak://host:port/namespace" DSN. Port defaults to
+// 8087 (Riak's protobuf port) if omitted.
+func parseRiakDSN(dsn string) (host string, port uint16, namespace string, err error) {
+	u, perr := url.Parse(dsn)
+	if perr != nil || u.Scheme != "riak" || u.Hostname() == "" {
+		return "", 0, "", fmt.Errorf("invalid riak dsn %q: expected riak://host:port/namespace", dsn)
+	}
+	portStr := u.Port()
+	if portStr == "" {
+		portStr = "8087"
+	}
+	p, perr := strconv.ParseUint(portStr, 10, 16)
+	if perr != nil {
+		return "", 0, "", fmt.Errorf("invalid riak dsn %q: bad port: %w", dsn, perr)
+	}
+	namespace = strings.TrimPrefix(u.Path, "/")
+	if namespace == "" {
+		return "", 0, "", fmt.Errorf("invalid riak dsn %q: missing namespace", dsn)
+	}
+	return u.Hostname(), uint16(p), namespace, nil
+}
+
 type KVStore interface {
 	Connect() error
 	InitBackend() error
@@ -20,31 +68,132 @@ type KVStore interface {
 	Metadata(key uint64) (*bangpb.InodeMeta, []byte, error)
 	UpdateMetadata(key uint64, newMeta *bangpb.InodeMeta, vclockIn []byte) ([]byte, error)
 	DeleteMetadata(key uint64, vclockIn []byte) error
+	// PutMetadataBytes, MetadataBytes, and UpdateMetadataBytes expose the same
+	// CAS semantics as their typed counterparts but operate on an already
+	// encoded blob instead of marshalling/unmarshalling *bangpb.InodeMeta.
+	// Decorators that need to transform the wire bytes (e.g. EncryptedKVStore)
+	// use these instead of re-deriving the marshalling step.
+	PutMetadataBytes(key uint64, data []byte) ([]byte, error)
+	MetadataBytes(key uint64) ([]byte, []byte, error)
+	UpdateMetadataBytes(key uint64, data []byte, vclockIn []byte) ([]byte, error)
+	// PutChunk stores data under key, which callers derive from
+	// bangutil.ChunkKey(bangutil.HashChunk(data)) so that identical chunk
+	// content always maps to the same key. If a chunk already exists at
+	// key, PutChunk skips the (redundant) write and just records another
+	// reference to it; the first writer's bytes are assumed canonical.
+	// Every PutChunk must be balanced by exactly one DeleteChunk.
 	PutChunk(key uint64, data []byte) error
 	Chunk(key uint64) ([]byte, error)
+	// DeleteChunk releases one reference to the chunk at key, physically
+	// removing it only once its refcount drops to zero. Deleting an
+	// already-absent or already-zero-refcount chunk is a no-op.
 	DeleteChunk(key uint64) error
+	// ChunkRefCount reports the current reference count for key, or 0 if
+	// it doesn't exist. Exposed mainly for tests and GC tooling.
+	ChunkRefCount(key uint64) (uint64, error)
+	// SetDedupEnabled persists (per namespace) whether PutChunk should skip
+	// re-writing a chunk whose key already exists. mkfs-bangfs's -dedup
+	// flag calls this once at filesystem-creation time; a namespace where
+	// it was never called has dedup on (see DedupEnabled).
+	SetDedupEnabled(enabled bool) error
+	// DedupEnabled reports the current dedup setting, defaulting to true
+	// if it was never explicitly set (matches PutChunk's long-standing
+	// behavior from before this was configurable).
+	DedupEnabled() (bool, error)
+	// SetDentryMode persists (per namespace) whether a directory's children
+	// are stored as individual dentry objects in a secondary-index-queryable
+	// bucket instead of being embedded in the parent's ChildEntries. Off by
+	// default so namespaces created before this existed keep working
+	// unchanged; mkfs-bangfs's -dentry-dirs flag calls this once at
+	// creation time.
+	SetDentryMode(enabled bool) error
+	// DentryMode reports the current dentry-mode setting, defaulting to
+	// false (embedded ChildEntries) if it was never explicitly set.
+	DentryMode() (bool, error)
+	// PutDentry stores (or overwrites) the dentry for entry.Name under
+	// parent. Only meaningful once DentryMode is enabled for parent's
+	// filesystem; Create/Mkdir use this instead of rewriting parent's
+	// ChildEntries.
+	PutDentry(parent uint64, entry *bangpb.ChildEntry) error
+	// DeleteDentry removes the dentry for name under parent. A no-op if it
+	// doesn't exist.
+	DeleteDentry(parent uint64, name string) error
+	// ListChildren returns every ChildEntry stored under parent via a
+	// range/secondary-index scan, for backends with dentry mode enabled.
+	ListChildren(parent uint64) ([]*bangpb.ChildEntry, error)
 	WipeBackend(w io.Writer) error
+	// ListKeys streams every key in bucket (metadataBucket and chunkBucket on
+	// every backend; chunkRefcountBucket on RiakKVStore only) to ch, closing
+	// ch when done or when ctx is cancelled. Backed by a true streaming scan where the backend
+	// supports one (RiakKVStore), so callers — WipeBackendCtx today, GC/fsck
+	// tooling later — never have to materialize a whole bucket's keys.
+	ListKeys(ctx context.Context, bucket string, ch chan<- string) error
+	// WipeBackendCtx is WipeBackend with a cancellable context and tunable
+	// options. WipeBackend is expected to call this with
+	// context.Background() and DefaultWipeOptions().
+	WipeBackendCtx(ctx context.Context, w io.Writer, opts WipeOptions) error
+}
+
+// WipeOptions tunes WipeBackendCtx's concurrency.
+type WipeOptions struct {
+	// Workers is the size of the bounded worker pool used to delete keys
+	// concurrently as they're streamed in. <= 0 means DefaultWipeOptions's
+	// Workers.
+	Workers int
+}
+
+// DefaultWipeOptions returns the options WipeBackend uses.
+func DefaultWipeOptions() WipeOptions {
+	return WipeOptions{Workers: 32}
 }
 
 const metadataBucket = "metadata"
 const chunkBucket = "chunks"
+const chunkRefcountBucket = "chunk_refcounts"
+const dentryBucket = "dentries"
+
+// dedupConfigKey is a reserved metadata-bucket key (distinct from any inode
+// number) holding the filesystem's dedup on/off setting as a single byte.
+const dedupConfigKey = "_dedup_config"
+
+// dentryModeConfigKey is a reserved metadata-bucket key holding the
+// filesystem's dentry-mode on/off setting as a single byte. See
+// SetDentryMode.
+const dentryModeConfigKey = "_dentry_mode"
+
+// dentryIndexName is the Riak 2i integer index tagged on every dentry
+// object, so ListChildren can range-query all of a parent's children
+// without reading (or rewriting) the parent's own object.
+const dentryIndexName = "parent_inode_int"
 
 // RiakKVStore holds a connection to the Riak backend
 type RiakKVStore struct {
-	metadataBucketType string
-	chunkBucketType    string
-	cluster            *riak.Cluster
-	host               string
-	pb_port            uint16
+	metadataBucketType      string
+	chunkBucketType         string
+	chunkRefcountBucketType string
+	dentryBucketType        string
+	cluster                 *riak.Cluster
+	host                    string
+	pb_port                 uint16
+
+	dedupMu      sync.Mutex
+	dedupLoaded  bool
+	dedupEnabled bool
+
+	dentryModeMu      sync.Mutex
+	dentryModeLoaded  bool
+	dentryModeEnabled bool
 }
 
 // NewRiakKVStore creates a new KVStore instance
 func NewRiakKVStore(host string, port uint16, namespace string) (*RiakKVStore, error) {
 	kv := &RiakKVStore{
-		metadataBucketType: namespace + "_bangfs_metadata",
-		chunkBucketType:    namespace + "_bangfs_chunks",
-		host:               host,
-		pb_port:            port,
+		metadataBucketType:      namespace + "_bangfs_metadata",
+		chunkBucketType:         namespace + "_bangfs_chunks",
+		chunkRefcountBucketType: namespace + "_bangfs_chunk_refcounts",
+		dentryBucketType:        namespace + "_bangfs_dentries",
+		host:                    host,
+		pb_port:                 port,
 	}
 	if err := kv.Connect(); err != nil {
 		return kv, err // for latter printing of the values
@@ -130,12 +279,17 @@ func (kv *RiakKVStore) Close() error {
 // If the key already exists, the function will fail.
 // TODO: implement retries
 func (kv *RiakKVStore) PutMetadata(key uint64, newMeta *bangpb.InodeMeta) ([]byte, error) {
-
 	data, err := proto.Marshal(newMeta)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
 	}
+	return kv.PutMetadataBytes(key, data)
+}
 
+// PutMetadataBytes is the byte-level counterpart of PutMetadata: it skips
+// the marshalling step so decorators can substitute a transformed blob
+// (e.g. ciphertext) while keeping the same CAS semantics.
+func (kv *RiakKVStore) PutMetadataBytes(key uint64, data []byte) ([]byte, error) {
 	obj := &riak.Object{
 		Bucket:      metadataBucket,
 		BucketType:  kv.metadataBucketType, // TODO: Check if passing ButcketType is redundant
@@ -170,12 +324,15 @@ func (kv *RiakKVStore) PutMetadata(key uint64, newMeta *bangpb.InodeMeta) ([]byt
 // UpdateMetadata stores inode metadata with optimistic concurrency control.
 // Its intended to fail if the metadata has been updated since the last read.
 func (kv *RiakKVStore) UpdateMetadata(key uint64, newMeta *bangpb.InodeMeta, vclock_in []byte) ([]byte, error) {
-
 	data, err := proto.Marshal(newMeta)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
 	}
+	return kv.UpdateMetadataBytes(key, data, vclock_in)
+}
 
+// UpdateMetadataBytes is the byte-level counterpart of UpdateMetadata.
+func (kv *RiakKVStore) UpdateMetadataBytes(key uint64, data []byte, vclock_in []byte) ([]byte, error) {
 	obj := &riak.Object{
 		Bucket:      metadataBucket,
 		BucketType:  kv.metadataBucketType,
@@ -197,6 +354,12 @@ func (kv *RiakKVStore) UpdateMetadata(key uint64, newMeta *bangpb.InodeMeta, vcl
 	}
 
 	if err := kv.cluster.Execute(cmd); err != nil {
+		// Riak's protobuf client surfaces a failed IfNotModified precondition
+		// as a plain error whose message contains "modified" — there's no
+		// typed error for it in the client library to check instead.
+		if strings.Contains(err.Error(), "modified") {
+			return nil, fmt.Errorf("%w: %v", ErrVClockConflict, err)
+		}
 		return nil, fmt.Errorf("failed to execute store: %w", err)
 	}
 	svc := cmd.(*riak.StoreValueCommand)
@@ -205,6 +368,21 @@ func (kv *RiakKVStore) UpdateMetadata(key uint64, newMeta *bangpb.InodeMeta, vcl
 
 // GetMeta retrieves inode metadata
 func (kv *RiakKVStore) Metadata(key uint64) (*bangpb.InodeMeta /*vclock*/, []byte, error) {
+	data, vclock, err := kv.MetadataBytes(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta := &bangpb.InodeMeta{}
+	if err := proto.Unmarshal(data, meta); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	return meta, vclock, nil
+}
+
+// MetadataBytes is the byte-level counterpart of Metadata: it returns the
+// raw stored value instead of unmarshalling it into a *bangpb.InodeMeta.
+func (kv *RiakKVStore) MetadataBytes(key uint64) ([]byte, []byte, error) {
 	cmd, err := riak.NewFetchValueCommandBuilder().
 		WithBucketType(kv.metadataBucketType).
 		WithBucket(metadataBucket).
@@ -223,11 +401,7 @@ func (kv *RiakKVStore) Metadata(key uint64) (*bangpb.InodeMeta /*vclock*/, []byt
 		return nil, nil, fmt.Errorf("key not found: %d", key)
 	}
 
-	meta := &bangpb.InodeMeta{}
-	if err := proto.Unmarshal(fvc.Response.Values[0].Value, meta); err != nil {
-		return nil, nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
-	}
-	return meta, fvc.Response.VClock, nil
+	return fvc.Response.Values[0].Value, fvc.Response.VClock, nil
 }
 
 // DeleteMetadata deletes inode metadata with optimistic concurrency control.
@@ -251,8 +425,23 @@ func (kv *RiakKVStore) DeleteMetadata(key uint64, vclockIn []byte) error {
 	return nil
 }
 
-// PutChunk stores a chunk by its key
+// PutChunk stores a chunk by its content-addressed key. If dedup is
+// enabled (the default — see DedupEnabled) and the key is already present,
+// it skips the write and just records another reference to it; otherwise
+// it always writes, matching the pre-dedup behavior for namespaces that
+// opted out via mkfs-bangfs -dedup=false.
 func (kv *RiakKVStore) PutChunk(key uint64, data []byte) error {
+	dedup, err := kv.DedupEnabled()
+	if err != nil {
+		return fmt.Errorf("failed to load dedup setting: %w", err)
+	}
+	if dedup {
+		if existing, err := kv.Chunk(key); err == nil && existing != nil {
+			_, err := kv.bumpChunkRefcount(key, 1)
+			return err
+		}
+	}
+
 	obj := &riak.Object{
 		Bucket:      chunkBucket,
 		BucketType:  kv.chunkBucketType,
@@ -273,6 +462,10 @@ func (kv *RiakKVStore) PutChunk(key uint64, data []byte) error {
 	if err := kv.cluster.Execute(cmd); err != nil {
 		return fmt.Errorf("failed to execute store: %w", err)
 	}
+
+	if _, err := kv.bumpChunkRefcount(key, 1); err != nil {
+		return fmt.Errorf("failed to seed refcount: %w", err)
+	}
 	return nil
 }
 
@@ -299,8 +492,17 @@ func (kv *RiakKVStore) Chunk(key uint64) ([]byte, error) {
 	return fvc.Response.Values[0].Value, nil
 }
 
-// DeleteChunk deletes a chunk by its key
+// DeleteChunk releases one reference to the chunk at key, physically
+// deleting it only once the refcount CRDT reaches zero.
 func (kv *RiakKVStore) DeleteChunk(key uint64) error {
+	remaining, err := kv.bumpChunkRefcount(key, -1)
+	if err != nil {
+		return fmt.Errorf("failed to decrement refcount: %w", err)
+	}
+	if remaining > 0 {
+		return nil
+	}
+
 	cmd, err := riak.NewDeleteValueCommandBuilder().
 		WithBucketType(kv.chunkBucketType).
 		WithBucket(chunkBucket).
@@ -316,72 +518,475 @@ func (kv *RiakKVStore) DeleteChunk(key uint64) error {
 	return nil
 }
 
-// WipeBackend deletes all metadata and chunks from the backend.
-// Progress is written to w (pass io.Discard or os.Stderr).
-func (kv *RiakKVStore) WipeBackend(w io.Writer) error {
-	if kv.cluster == nil {
-		return fmt.Errorf("cluster not connected")
+// bumpChunkRefcount applies delta to key's refcount CRDT and returns the
+// resulting value. Riak counters are an atomic increment-only CRDT, so this
+// is race-free even with concurrent PutChunk/DeleteChunk calls for the same
+// key across multiple bangfs mounts — unlike the metadata path, no vclock
+// CAS retry loop is needed here.
+func (kv *RiakKVStore) bumpChunkRefcount(key uint64, delta int64) (int64, error) {
+	cmd, err := riak.NewUpdateCounterCommandBuilder().
+		WithBucketType(kv.chunkRefcountBucketType).
+		WithBucket(chunkRefcountBucket).
+		WithKey(fmt.Sprintf("%016x", key)).
+		WithIncrement(delta).
+		WithReturnBody(true).
+		Build()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build counter update command: %w", err)
+	}
+	if err := kv.cluster.Execute(cmd); err != nil {
+		return 0, fmt.Errorf("failed to execute counter update: %w", err)
+	}
+	ucc := cmd.(*riak.UpdateCounterCommand)
+	if ucc.Response == nil {
+		return 0, fmt.Errorf("didn't get counter response")
 	}
+	return ucc.Response.CounterValue, nil
+}
 
-	fmt.Fprintf(w, "  wiping metadata [%s/%s]...\n", kv.metadataBucketType, metadataBucket)
-	num_meta_keys, err := kv.wipeBucket(w, kv.metadataBucketType, metadataBucket)
+// ChunkRefCount reports the current reference count for key, or 0 if it has
+// never been written (or was already GC'd down to zero).
+func (kv *RiakKVStore) ChunkRefCount(key uint64) (uint64, error) {
+	cmd, err := riak.NewFetchCounterCommandBuilder().
+		WithBucketType(kv.chunkRefcountBucketType).
+		WithBucket(chunkRefcountBucket).
+		WithKey(fmt.Sprintf("%016x", key)).
+		Build()
 	if err != nil {
-		return fmt.Errorf("failed to wipe metadata bucket: %w", err)
+		return 0, fmt.Errorf("failed to build counter fetch command: %w", err)
+	}
+	if err := kv.cluster.Execute(cmd); err != nil {
+		return 0, fmt.Errorf("failed to execute counter fetch: %w", err)
 	}
-	fmt.Fprintf(w, "  deleted %d metadata keys\n", num_meta_keys)
+	fcc := cmd.(*riak.FetchCounterCommand)
+	if fcc.Response == nil || fcc.Response.IsNotFound {
+		return 0, nil
+	}
+	return uint64(fcc.Response.CounterValue), nil
+}
 
-	fmt.Fprintf(w, "  wiping chunks [%s/%s]...\n", kv.chunkBucketType, chunkBucket)
-	num_chunk_keys, err := kv.wipeBucket(w, kv.chunkBucketType, chunkBucket)
+// SetDedupEnabled persists the dedup setting for this namespace as a plain
+// (non-CAS) object in the metadata bucket: it's an operator-driven toggle,
+// not data subject to concurrent filesystem writers, so it doesn't need the
+// vclock dance PutMetadataBytes uses.
+func (kv *RiakKVStore) SetDedupEnabled(enabled bool) error {
+	value := byte(0)
+	if enabled {
+		value = 1
+	}
+	obj := &riak.Object{
+		Bucket:      metadataBucket,
+		BucketType:  kv.metadataBucketType,
+		Key:         dedupConfigKey,
+		ContentType: "application/octet-stream",
+		Value:       []byte{value},
+	}
+	cmd, err := riak.NewStoreValueCommandBuilder().
+		WithBucketType(kv.metadataBucketType).
+		WithBucket(metadataBucket).
+		WithContent(obj).
+		Build()
 	if err != nil {
-		return fmt.Errorf("failed to wipe chunk bucket: %w", err)
+		return fmt.Errorf("failed to build store command: %w", err)
+	}
+	if err := kv.cluster.Execute(cmd); err != nil {
+		return fmt.Errorf("failed to execute store: %w", err)
 	}
-	fmt.Fprintf(w, "  deleted %d chunk keys\n", num_chunk_keys)
 
+	kv.dedupMu.Lock()
+	kv.dedupLoaded = true
+	kv.dedupEnabled = enabled
+	kv.dedupMu.Unlock()
 	return nil
 }
 
-// wipeBucket deletes all keys in a bucket
-func (kv *RiakKVStore) wipeBucket(w io.Writer, bucketType, bucket string) (int, error) {
+// DedupEnabled reports the namespace's dedup setting, caching it in memory
+// after the first read since it's only ever changed by SetDedupEnabled (on
+// this same instance) or an operator re-running mkfs-bangfs between mounts.
+func (kv *RiakKVStore) DedupEnabled() (bool, error) {
+	kv.dedupMu.Lock()
+	if kv.dedupLoaded {
+		defer kv.dedupMu.Unlock()
+		return kv.dedupEnabled, nil
+	}
+	kv.dedupMu.Unlock()
 
-	// List all keys in the bucket
-	cmd, err := riak.NewListKeysCommandBuilder().
-		WithBucketType(bucketType).
-		WithBucket(bucket).
-		WithStreaming(false).
+	cmd, err := riak.NewFetchValueCommandBuilder().
+		WithBucketType(kv.metadataBucketType).
+		WithBucket(metadataBucket).
+		WithKey(dedupConfigKey).
+		Build()
+	if err != nil {
+		return false, fmt.Errorf("failed to build fetch command: %w", err)
+	}
+	if err := kv.cluster.Execute(cmd); err != nil {
+		return false, fmt.Errorf("failed to execute fetch: %w", err)
+	}
+
+	enabled := true // default: dedup on, matching behavior before this was configurable
+	fvc := cmd.(*riak.FetchValueCommand)
+	if fvc.Response != nil && len(fvc.Response.Values) > 0 && len(fvc.Response.Values[0].Value) > 0 {
+		enabled = fvc.Response.Values[0].Value[0] != 0
+	}
+
+	kv.dedupMu.Lock()
+	kv.dedupLoaded = true
+	kv.dedupEnabled = enabled
+	kv.dedupMu.Unlock()
+	return enabled, nil
+}
+
+// SetDentryMode persists the dentry-mode setting for this namespace the
+// same way SetDedupEnabled does: a plain object, since it's an
+// operator-driven toggle rather than data subject to concurrent writers.
+func (kv *RiakKVStore) SetDentryMode(enabled bool) error {
+	value := byte(0)
+	if enabled {
+		value = 1
+	}
+	obj := &riak.Object{
+		Bucket:      metadataBucket,
+		BucketType:  kv.metadataBucketType,
+		Key:         dentryModeConfigKey,
+		ContentType: "application/octet-stream",
+		Value:       []byte{value},
+	}
+	cmd, err := riak.NewStoreValueCommandBuilder().
+		WithBucketType(kv.metadataBucketType).
+		WithBucket(metadataBucket).
+		WithContent(obj).
 		Build()
 	if err != nil {
-		return 0, fmt.Errorf("failed to build list keys command: %w", err)
+		return fmt.Errorf("failed to build store command: %w", err)
+	}
+	if err := kv.cluster.Execute(cmd); err != nil {
+		return fmt.Errorf("failed to execute store: %w", err)
 	}
 
+	kv.dentryModeMu.Lock()
+	kv.dentryModeLoaded = true
+	kv.dentryModeEnabled = enabled
+	kv.dentryModeMu.Unlock()
+	return nil
+}
+
+// DentryMode reports the namespace's dentry-mode setting, caching it in
+// memory after the first read for the same reason DedupEnabled does.
+func (kv *RiakKVStore) DentryMode() (bool, error) {
+	kv.dentryModeMu.Lock()
+	if kv.dentryModeLoaded {
+		defer kv.dentryModeMu.Unlock()
+		return kv.dentryModeEnabled, nil
+	}
+	kv.dentryModeMu.Unlock()
+
+	cmd, err := riak.NewFetchValueCommandBuilder().
+		WithBucketType(kv.metadataBucketType).
+		WithBucket(metadataBucket).
+		WithKey(dentryModeConfigKey).
+		Build()
+	if err != nil {
+		return false, fmt.Errorf("failed to build fetch command: %w", err)
+	}
 	if err := kv.cluster.Execute(cmd); err != nil {
-		return 0, fmt.Errorf("failed to list keys: %w", err)
+		return false, fmt.Errorf("failed to execute fetch: %w", err)
+	}
+
+	enabled := false // default: embedded ChildEntries, matching behavior before dentry mode existed
+	fvc := cmd.(*riak.FetchValueCommand)
+	if fvc.Response != nil && len(fvc.Response.Values) > 0 && len(fvc.Response.Values[0].Value) > 0 {
+		enabled = fvc.Response.Values[0].Value[0] != 0
+	}
+
+	kv.dentryModeMu.Lock()
+	kv.dentryModeLoaded = true
+	kv.dentryModeEnabled = enabled
+	kv.dentryModeMu.Unlock()
+	return enabled, nil
+}
+
+// dentryKey formats the dentry bucket key for a (parent, name) pair.
+func dentryKey(parent uint64, name string) string {
+	return fmt.Sprintf("%d/%s", parent, name)
+}
+
+// PutDentry stores entry as its own small object in the dentry bucket,
+// tagged with the parent_inode_int 2i index so ListChildren can range-query
+// it without touching parent's own object. Unlike metadata, dentries have
+// no concurrent-writer CAS requirement of their own: each (parent, name)
+// pair is only ever written by the single Create/Mkdir/Rename call that
+// owns that name.
+func (kv *RiakKVStore) PutDentry(parent uint64, entry *bangpb.ChildEntry) error {
+	data, err := proto.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dentry: %w", err)
 	}
+	obj := &riak.Object{
+		Bucket:      dentryBucket,
+		BucketType:  kv.dentryBucketType,
+		Key:         dentryKey(parent, entry.Name),
+		ContentType: "application/protobuf",
+		Value:       data,
+		Indexes: map[string][]string{
+			dentryIndexName: {fmt.Sprintf("%d", parent)},
+		},
+	}
+	cmd, err := riak.NewStoreValueCommandBuilder().
+		WithBucketType(kv.dentryBucketType).
+		WithBucket(dentryBucket).
+		WithContent(obj).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build store command: %w", err)
+	}
+	if err := kv.cluster.Execute(cmd); err != nil {
+		return fmt.Errorf("failed to execute store: %w", err)
+	}
+	return nil
+}
+
+// DeleteDentry removes the dentry for name under parent.
+func (kv *RiakKVStore) DeleteDentry(parent uint64, name string) error {
+	cmd, err := riak.NewDeleteValueCommandBuilder().
+		WithBucketType(kv.dentryBucketType).
+		WithBucket(dentryBucket).
+		WithKey(dentryKey(parent, name)).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build delete command: %w", err)
+	}
+	if err := kv.cluster.Execute(cmd); err != nil {
+		return fmt.Errorf("failed to execute delete: %w", err)
+	}
+	return nil
+}
 
-	lkc := cmd.(*riak.ListKeysCommand)
-	if lkc.Response == nil {
-		return 0, fmt.Errorf("no keys found in bucket: %v", bucket)
+// ListChildren runs a 2i range query against parent_inode_int to find every
+// dentry under parent, then fetches and unmarshals each one. This replaces
+// a parent-object read (unbounded by directory size under embedded
+// ChildEntries) with a query proportional to the directory's fan-out.
+func (kv *RiakKVStore) ListChildren(parent uint64) ([]*bangpb.ChildEntry, error) {
+	idxCmd, err := riak.NewSecondaryIndexQueryCommandBuilder().
+		WithBucketType(kv.dentryBucketType).
+		WithBucket(dentryBucket).
+		WithIndexName(dentryIndexName).
+		WithIntIndexKey(int(parent)).
+		Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build 2i query command: %w", err)
+	}
+	if err := kv.cluster.Execute(idxCmd); err != nil {
+		return nil, fmt.Errorf("failed to execute 2i query: %w", err)
 	}
 
-	total := len(lkc.Response.Keys)
-	fmt.Fprintf(w, "  found %d keys in %s/%s\n", total, bucketType, bucket)
+	siq := idxCmd.(*riak.SecondaryIndexQueryCommand)
+	if siq.Response == nil {
+		return nil, nil
+	}
 
-	// Delete each key
-	keycount := 0
-	for _, key := range lkc.Response.Keys {
-		del_cmd, err := riak.NewDeleteValueCommandBuilder().
-			WithBucketType(bucketType).
-			WithBucket(bucket).
-			WithKey(string(key)).
+	entries := make([]*bangpb.ChildEntry, 0, len(siq.Response.Results))
+	for _, result := range siq.Response.Results {
+		fetchCmd, err := riak.NewFetchValueCommandBuilder().
+			WithBucketType(kv.dentryBucketType).
+			WithBucket(dentryBucket).
+			WithKey(string(result.ObjectKey)).
 			Build()
 		if err != nil {
-			return 0, fmt.Errorf("failed to build delete command for key %s: %w", key, err)
+			return nil, fmt.Errorf("failed to build fetch command: %w", err)
+		}
+		if err := kv.cluster.Execute(fetchCmd); err != nil {
+			return nil, fmt.Errorf("failed to fetch dentry %s: %w", result.ObjectKey, err)
+		}
+		fvc := fetchCmd.(*riak.FetchValueCommand)
+		if fvc.Response == nil || len(fvc.Response.Values) == 0 {
+			continue // raced with a concurrent delete; just skip it
 		}
+		entry := &bangpb.ChildEntry{}
+		if err := proto.Unmarshal(fvc.Response.Values[0].Value, entry); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal dentry %s: %w", result.ObjectKey, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// bucketTypeFor resolves one of the package-level bucket name constants
+// (metadataBucket, chunkBucket, chunkRefcountBucket) to this store's
+// namespaced Riak bucket-type.
+func (kv *RiakKVStore) bucketTypeFor(bucket string) (string, error) {
+	switch bucket {
+	case metadataBucket:
+		return kv.metadataBucketType, nil
+	case chunkBucket:
+		return kv.chunkBucketType, nil
+	case chunkRefcountBucket:
+		return kv.chunkRefcountBucketType, nil
+	case dentryBucket:
+		return kv.dentryBucketType, nil
+	default:
+		return "", fmt.Errorf("unknown bucket %q", bucket)
+	}
+}
 
-		if err := kv.cluster.Execute(del_cmd); err != nil {
-			return 0, fmt.Errorf("failed to delete key %s: %w", key, err)
+// ListKeys streams bucket's keys to ch via a true Riak streaming ListKeys
+// (a coverage query across every vnode — expensive regardless, but this way
+// at least avoids also materializing the whole result set in memory). ch is
+// closed when the scan finishes or ctx is cancelled.
+func (kv *RiakKVStore) ListKeys(ctx context.Context, bucket string, ch chan<- string) error {
+	defer close(ch)
+
+	bucketType, err := kv.bucketTypeFor(bucket)
+	if err != nil {
+		return err
+	}
+
+	cb := func(keys []string) error {
+		for _, key := range keys {
+			select {
+			case ch <- key:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
-		keycount++
+		return nil
 	}
 
-	return keycount, nil
+	cmd, err := riak.NewListKeysCommandBuilder().
+		WithBucketType(bucketType).
+		WithBucket(bucket).
+		WithStreaming(true).
+		WithCallback(cb).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build list keys command: %w", err)
+	}
+
+	execDone := make(chan error, 1)
+	go func() { execDone <- kv.cluster.Execute(cmd) }()
+
+	select {
+	case err := <-execDone:
+		if err != nil {
+			return fmt.Errorf("failed to list keys: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WipeBackend deletes all metadata, chunks, and chunk refcounts from the
+// backend with the default options and no cancellation. Progress is written
+// to w (pass io.Discard or os.Stderr).
+func (kv *RiakKVStore) WipeBackend(w io.Writer) error {
+	return kv.WipeBackendCtx(context.Background(), w, DefaultWipeOptions())
+}
+
+// WipeBackendCtx is WipeBackend with cancellation and tunable worker-pool
+// concurrency. Keys are streamed in via ListKeys (never materialized as a
+// full list) and deleted concurrently by opts.Workers goroutines; progress
+// (count + rate) is reported to w roughly once a second. Cancelling ctx
+// stops the sweep early rather than leaving it to run to completion.
+func (kv *RiakKVStore) WipeBackendCtx(ctx context.Context, w io.Writer, opts WipeOptions) error {
+	if kv.cluster == nil {
+		return fmt.Errorf("cluster not connected")
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultWipeOptions().Workers
+	}
+
+	for _, b := range []struct{ bucketType, bucket string }{
+		{kv.metadataBucketType, metadataBucket},
+		{kv.chunkBucketType, chunkBucket},
+		{kv.chunkRefcountBucketType, chunkRefcountBucket},
+		{kv.dentryBucketType, dentryBucket},
+	} {
+		fmt.Fprintf(w, "  wiping %s [%s/%s]...\n", b.bucket, b.bucketType, b.bucket)
+		n, err := kv.wipeBucketStreamed(ctx, w, b.bucketType, b.bucket, workers)
+		if err != nil {
+			return fmt.Errorf("failed to wipe %s bucket: %w", b.bucket, err)
+		}
+		fmt.Fprintf(w, "  deleted %d keys from %s\n", n, b.bucket)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// wipeBucketStreamed drains bucket's streamed keys (see ListKeys) into a
+// bounded pool of workers goroutines that each issue deletes, reporting
+// incremental progress to w until the pool and the scan both finish.
+func (kv *RiakKVStore) wipeBucketStreamed(ctx context.Context, w io.Writer, bucketType, bucket string, workers int) (int, error) {
+	keys := make(chan string, workers*4)
+	listDone := make(chan error, 1)
+	go func() { listDone <- kv.ListKeys(ctx, bucket, keys) }()
+
+	var deleted int64
+	var firstErr error
+	var errMu sync.Mutex
+	recordErr := func(err error) {
+		errMu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		errMu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				if ctx.Err() != nil {
+					continue // drain without deleting so the channel unblocks ListKeys
+				}
+				cmd, err := riak.NewDeleteValueCommandBuilder().
+					WithBucketType(bucketType).
+					WithBucket(bucket).
+					WithKey(key).
+					Build()
+				if err == nil {
+					err = kv.cluster.Execute(cmd)
+				}
+				if err != nil {
+					recordErr(fmt.Errorf("failed to delete key %s: %w", key, err))
+					continue
+				}
+				atomic.AddInt64(&deleted, 1)
+			}
+		}()
+	}
+
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		start := time.Now()
+		var last int64
+		for {
+			select {
+			case <-ticker.C:
+				n := atomic.LoadInt64(&deleted)
+				fmt.Fprintf(w, "    %d deleted (%d/s, %.1fs elapsed)\n", n, n-last, time.Since(start).Seconds())
+				last = n
+			case <-stopProgress:
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stopProgress)
+	<-progressDone
+
+	if err := <-listDone; err != nil && firstErr == nil && err != context.Canceled {
+		firstErr = err
+	}
+	return int(atomic.LoadInt64(&deleted)), firstErr
 }
@@ -0,0 +1,287 @@
+package bangfuse
+
+import (
+	"container/list"
+	"sync"
+
+	bangpb "bangfs/proto"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// cachedMeta is the value held in CachingKVStore's metadata LRU.
+type cachedMeta struct {
+	key    uint64
+	meta   *bangpb.InodeMeta
+	vclock []byte
+}
+
+// cachedChunk is the value held in CachingKVStore's chunk LRU. Its share of
+// the byte budget is len(data); no separate size is stored.
+type cachedChunk struct {
+	key  uint64
+	data []byte
+}
+
+// CachingKVStore decorates a KVStore with two independent, bounded LRUs: one
+// for InodeMeta/vclock pairs (entry-count bounded, since metadata is small
+// and roughly uniform in size) and one for chunk bytes (byte-budget
+// bounded, since chunks can be up to gChunksize each). It exists to absorb
+// the getattr/lookup storms a recursive `ls -lR` generates against Riak,
+// which otherwise round-trips for every single inode.
+//
+// Metadata reads are served from cache on hit; writes go through to the
+// backend first and only update the cache on success, so a failed write
+// never leaves a stale, still-cached entry. A CAS failure (stale vclock)
+// evicts the entry outright rather than trying to repair it, so the next
+// read re-fetches the authoritative copy.
+type CachingKVStore struct {
+	KVStore
+
+	metaMaxEntries int
+	chunkMaxBytes  int64
+
+	mu         sync.Mutex
+	metaLRU    *list.List // of *cachedMeta, front = most recently used
+	metaIndex  map[uint64]*list.Element
+	chunkLRU   *list.List // of *cachedChunk, front = most recently used
+	chunkIndex map[uint64]*list.Element
+	chunkBytes int64
+}
+
+// NewCachingKVStore wraps kv with a metadata LRU bounded to metaMaxEntries
+// entries and a chunk LRU bounded to chunkMaxBytes total bytes. Either bound
+// may be 0 to disable that half of the cache.
+func NewCachingKVStore(kv KVStore, metaMaxEntries int, chunkMaxBytes int64) *CachingKVStore {
+	return &CachingKVStore{
+		KVStore:        kv,
+		metaMaxEntries: metaMaxEntries,
+		chunkMaxBytes:  chunkMaxBytes,
+		metaLRU:        list.New(),
+		metaIndex:      make(map[uint64]*list.Element),
+		chunkLRU:       list.New(),
+		chunkIndex:     make(map[uint64]*list.Element),
+	}
+}
+
+func (kv *CachingKVStore) metaGet(key uint64) (*bangpb.InodeMeta, []byte, bool) {
+	if kv.metaMaxEntries <= 0 {
+		return nil, nil, false
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	e, ok := kv.metaIndex[key]
+	if !ok {
+		return nil, nil, false
+	}
+	kv.metaLRU.MoveToFront(e)
+	cm := e.Value.(*cachedMeta)
+	return cm.meta, cm.vclock, true
+}
+
+func (kv *CachingKVStore) metaPut(key uint64, meta *bangpb.InodeMeta, vclock []byte) {
+	if kv.metaMaxEntries <= 0 {
+		return
+	}
+	// Store a copy: meta may be a caller's still-live object (e.g. the one
+	// passed to UpdateMetadata) that they keep mutating after this call
+	// returns, and it must not alias what future Metadata() callers see.
+	cloned := proto.Clone(meta).(*bangpb.InodeMeta)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if e, ok := kv.metaIndex[key]; ok {
+		e.Value.(*cachedMeta).meta = cloned
+		e.Value.(*cachedMeta).vclock = vclock
+		kv.metaLRU.MoveToFront(e)
+		return
+	}
+	e := kv.metaLRU.PushFront(&cachedMeta{key: key, meta: cloned, vclock: vclock})
+	kv.metaIndex[key] = e
+	for kv.metaLRU.Len() > kv.metaMaxEntries {
+		kv.evictOldestMetaLocked()
+	}
+}
+
+func (kv *CachingKVStore) evictOldestMetaLocked() {
+	e := kv.metaLRU.Back()
+	if e == nil {
+		return
+	}
+	kv.metaLRU.Remove(e)
+	delete(kv.metaIndex, e.Value.(*cachedMeta).key)
+}
+
+func (kv *CachingKVStore) metaInvalidate(key uint64) {
+	if kv.metaMaxEntries <= 0 {
+		return
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if e, ok := kv.metaIndex[key]; ok {
+		kv.metaLRU.Remove(e)
+		delete(kv.metaIndex, key)
+	}
+}
+
+func (kv *CachingKVStore) chunkGet(key uint64) ([]byte, bool) {
+	if kv.chunkMaxBytes <= 0 {
+		return nil, false
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	e, ok := kv.chunkIndex[key]
+	if !ok {
+		return nil, false
+	}
+	kv.chunkLRU.MoveToFront(e)
+	return e.Value.(*cachedChunk).data, true
+}
+
+func (kv *CachingKVStore) chunkPut(key uint64, data []byte) {
+	if kv.chunkMaxBytes <= 0 || int64(len(data)) > kv.chunkMaxBytes {
+		return
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if e, ok := kv.chunkIndex[key]; ok {
+		kv.chunkBytes -= int64(len(e.Value.(*cachedChunk).data))
+		e.Value.(*cachedChunk).data = data
+		kv.chunkBytes += int64(len(data))
+		kv.chunkLRU.MoveToFront(e)
+	} else {
+		e := kv.chunkLRU.PushFront(&cachedChunk{key: key, data: data})
+		kv.chunkIndex[key] = e
+		kv.chunkBytes += int64(len(data))
+	}
+	for kv.chunkBytes > kv.chunkMaxBytes {
+		kv.evictOldestChunkLocked()
+	}
+}
+
+func (kv *CachingKVStore) evictOldestChunkLocked() {
+	e := kv.chunkLRU.Back()
+	if e == nil {
+		return
+	}
+	kv.chunkLRU.Remove(e)
+	cc := e.Value.(*cachedChunk)
+	delete(kv.chunkIndex, cc.key)
+	kv.chunkBytes -= int64(len(cc.data))
+}
+
+func (kv *CachingKVStore) chunkInvalidate(key uint64) {
+	if kv.chunkMaxBytes <= 0 {
+		return
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if e, ok := kv.chunkIndex[key]; ok {
+		kv.chunkLRU.Remove(e)
+		kv.chunkBytes -= int64(len(e.Value.(*cachedChunk).data))
+		delete(kv.chunkIndex, key)
+	}
+}
+
+func (kv *CachingKVStore) Metadata(key uint64) (*bangpb.InodeMeta, []byte, error) {
+	if meta, vclock, ok := kv.metaGet(key); ok {
+		// Hand back a copy: the cached entry is shared across every caller
+		// that hits this key, and callers routinely mutate the returned
+		// meta in place (append to ChildEntries, bump Nlink, ...).
+		return proto.Clone(meta).(*bangpb.InodeMeta), vclock, nil
+	}
+	meta, vclock, err := kv.KVStore.Metadata(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	kv.metaPut(key, meta, vclock)
+	return meta, vclock, nil
+}
+
+func (kv *CachingKVStore) PutMetadata(key uint64, newMeta *bangpb.InodeMeta) ([]byte, error) {
+	vclock, err := kv.KVStore.PutMetadata(key, newMeta)
+	kv.metaInvalidate(key)
+	return vclock, err
+}
+
+func (kv *CachingKVStore) UpdateMetadata(key uint64, newMeta *bangpb.InodeMeta, vclockIn []byte) ([]byte, error) {
+	vclock, err := kv.KVStore.UpdateMetadata(key, newMeta, vclockIn)
+	if err != nil {
+		// Stale vclock (or any other failure) means our cached copy can no
+		// longer be trusted; evict so the next read re-fetches.
+		kv.metaInvalidate(key)
+		return nil, err
+	}
+	kv.metaPut(key, newMeta, vclock)
+	return vclock, nil
+}
+
+func (kv *CachingKVStore) DeleteMetadata(key uint64, vclockIn []byte) error {
+	err := kv.KVStore.DeleteMetadata(key, vclockIn)
+	kv.metaInvalidate(key)
+	return err
+}
+
+func (kv *CachingKVStore) Chunk(key uint64) ([]byte, error) {
+	if data, ok := kv.chunkGet(key); ok {
+		return data, nil
+	}
+	data, err := kv.KVStore.Chunk(key)
+	if err != nil {
+		return nil, err
+	}
+	kv.chunkPut(key, data)
+	return data, nil
+}
+
+func (kv *CachingKVStore) PutChunk(key uint64, data []byte) error {
+	err := kv.KVStore.PutChunk(key, data)
+	if err != nil {
+		return err
+	}
+	kv.chunkPut(key, data)
+	return nil
+}
+
+func (kv *CachingKVStore) DeleteChunk(key uint64) error {
+	err := kv.KVStore.DeleteChunk(key)
+	kv.chunkInvalidate(key)
+	return err
+}
+
+// PutChunkClass forwards to the wrapped store's PutChunkClass if it's
+// class-aware (see classAwareKVStore), falling back to plain PutChunk
+// otherwise, then caches data under key exactly like PutChunk.
+func (kv *CachingKVStore) PutChunkClass(class string, key uint64, data []byte) error {
+	var err error
+	if cc, ok := kv.KVStore.(classAwareKVStore); ok {
+		err = cc.PutChunkClass(class, key, data)
+	} else {
+		err = kv.KVStore.PutChunk(key, data)
+	}
+	if err != nil {
+		return err
+	}
+	kv.chunkPut(key, data)
+	return nil
+}
+
+// ChunkClass forwards to the wrapped store's ChunkClass if it's class-aware,
+// falling back to plain Chunk otherwise, serving from cache on hit exactly
+// like Chunk.
+func (kv *CachingKVStore) ChunkClass(class string, key uint64) ([]byte, error) {
+	if data, ok := kv.chunkGet(key); ok {
+		return data, nil
+	}
+	var data []byte
+	var err error
+	if cc, ok := kv.KVStore.(classAwareKVStore); ok {
+		data, err = cc.ChunkClass(class, key)
+	} else {
+		data, err = kv.KVStore.Chunk(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	kv.chunkPut(key, data)
+	return data, nil
+}
@@ -0,0 +1,103 @@
+package bangfuse
+
+import "testing"
+
+// CachingKVStore should be a transparent decorator: it must pass the same
+// shared test suite as any other KVStore.
+func TestCaching_SanityCheck(t *testing.T) {
+	testAllTests(t, NewCachingKVStore(testFileKV(t), 16, 1<<20))
+}
+
+func TestCaching_MetadataServedFromCache(t *testing.T) {
+	kv := NewCachingKVStore(testFileKV(t), 16, 0)
+
+	var inum uint64 = 9999902
+	meta := makeTestMeta("cached.txt")
+	if _, err := kv.PutMetadata(inum, meta); err != nil {
+		t.Fatalf("PutMetadata: %v", err)
+	}
+	if _, _, ok := kv.metaGet(inum); ok {
+		t.Fatalf("expected PutMetadata to invalidate rather than pre-warm the cache")
+	}
+
+	if _, _, err := kv.Metadata(inum); err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	if _, _, ok := kv.metaGet(inum); !ok {
+		t.Fatalf("expected Metadata to have warmed the cache on miss")
+	}
+}
+
+func TestCaching_EvictsOldestMetaEntryOverCapacity(t *testing.T) {
+	kv := NewCachingKVStore(testFileKV(t), 2, 0)
+
+	for i, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		inum := uint64(9999910 + i)
+		if _, err := kv.PutMetadata(inum, makeTestMeta(name)); err != nil {
+			t.Fatalf("PutMetadata(%d): %v", inum, err)
+		}
+		if _, _, err := kv.Metadata(inum); err != nil {
+			t.Fatalf("Metadata(%d): %v", inum, err)
+		}
+	}
+
+	if _, _, ok := kv.metaGet(9999910); ok {
+		t.Fatalf("expected the oldest entry to have been evicted once the cache exceeded capacity")
+	}
+	if kv.metaLRU.Len() > 2 {
+		t.Fatalf("expected at most 2 cached entries, got %d", kv.metaLRU.Len())
+	}
+}
+
+func TestCaching_UpdateMetadataEvictsOnStaleVclock(t *testing.T) {
+	kv := NewCachingKVStore(testFileKV(t), 16, 0)
+
+	var inum uint64 = 9999920
+	if _, err := kv.PutMetadata(inum, makeTestMeta("stale.txt")); err != nil {
+		t.Fatalf("PutMetadata: %v", err)
+	}
+	if _, _, err := kv.Metadata(inum); err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	if _, _, ok := kv.metaGet(inum); !ok {
+		t.Fatalf("expected Metadata to have warmed the cache")
+	}
+
+	if _, err := kv.UpdateMetadata(inum, makeTestMeta("stale2.txt"), []byte("bogus-vclock")); err == nil {
+		t.Fatalf("expected UpdateMetadata with a stale vclock to fail")
+	}
+
+	if _, _, ok := kv.metaGet(inum); ok {
+		t.Fatalf("expected a failed CAS to evict the stale cache entry")
+	}
+}
+
+func TestCaching_ChunkByteBudgetEviction(t *testing.T) {
+	kv := NewCachingKVStore(testFileKV(t), 0, 10)
+
+	data1 := []byte("0123456789") // exactly the budget
+	if err := kv.PutChunk(1, data1); err != nil {
+		t.Fatalf("PutChunk(1): %v", err)
+	}
+	if _, ok := kv.chunkGet(1); !ok {
+		t.Fatalf("expected chunk 1 to be cached")
+	}
+
+	data2 := []byte("abcdefghij") // forces chunk 1 out
+	if err := kv.PutChunk(2, data2); err != nil {
+		t.Fatalf("PutChunk(2): %v", err)
+	}
+	if _, ok := kv.chunkGet(1); ok {
+		t.Fatalf("expected chunk 1 to have been evicted to stay within the byte budget")
+	}
+	if _, ok := kv.chunkGet(2); !ok {
+		t.Fatalf("expected chunk 2 to be cached")
+	}
+
+	if err := kv.DeleteChunk(1); err != nil {
+		t.Fatalf("DeleteChunk(1): %v", err)
+	}
+	if err := kv.DeleteChunk(2); err != nil {
+		t.Fatalf("DeleteChunk(2): %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package bangfuse
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+	"google.golang.org/protobuf/proto"
+
+	bangpb "bangfs/proto"
+)
+
+// masterConfName is the file, stored at the backend root, holding the
+// scrypt salt used to derive the data-encryption key from the operator's
+// master key. It is created by whichever of NewEncryptedKVStore or
+// InitBackend first finds it missing, and never rewritten.
+const masterConfName = "master.conf"
+
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32 // AES-256
+	gcmNonceLen  = 12 // 96-bit nonce, prepended to ciphertext
+)
+
+// EncryptedKVStore decorates a KVStore with AES-256-GCM authenticated
+// encryption of chunk bytes and marshalled InodeMeta. Ciphertext blocks are
+// laid out as nonce||ciphertext||tag; the chunkPath/metaPath layout of the
+// wrapped store is untouched — only the bytes stored at each key change.
+// Metadata is bound to its inode number via AAD and chunks to their chunk
+// key, so ciphertext blobs can't be swapped between keys.
+type EncryptedKVStore struct {
+	KVStore
+	confDir string
+	dek     []byte // data-encryption key, derived from the master key
+}
+
+// NewEncryptedKVStore wraps kv with authenticated encryption, deriving the
+// data-encryption key from masterKey via scrypt using the salt stored at
+// confDir/master.conf (created here with a fresh random salt if it doesn't
+// exist yet).
+func NewEncryptedKVStore(kv KVStore, confDir string, masterKey []byte) (*EncryptedKVStore, error) {
+	ekv := &EncryptedKVStore{KVStore: kv, confDir: confDir}
+
+	salt, err := ekv.readOrCreateSalt()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load salt: %w", err)
+	}
+
+	dek, err := scrypt.Key(masterKey, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive data-encryption key: %w", err)
+	}
+	ekv.dek = dek
+	return ekv, nil
+}
+
+func (kv *EncryptedKVStore) saltPath() string {
+	return filepath.Join(kv.confDir, masterConfName)
+}
+
+// readOrCreateSalt reads the per-filesystem salt from master.conf, creating
+// it with fresh random bytes if InitBackend hasn't run yet.
+func (kv *EncryptedKVStore) readOrCreateSalt() ([]byte, error) {
+	salt, err := os.ReadFile(kv.saltPath())
+	if err == nil {
+		return salt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	salt = make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	if err := os.MkdirAll(kv.confDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backend root: %w", err)
+	}
+	if err := os.WriteFile(kv.saltPath(), salt, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write master.conf: %w", err)
+	}
+	return salt, nil
+}
+
+// InitBackend ensures master.conf exists before delegating to the wrapped
+// store, so a filesystem created once always has a stable salt.
+func (kv *EncryptedKVStore) InitBackend() error {
+	if _, err := kv.readOrCreateSalt(); err != nil {
+		return fmt.Errorf("failed to init master.conf: %w", err)
+	}
+	return kv.KVStore.InitBackend()
+}
+
+func (kv *EncryptedKVStore) newGCM() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kv.dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext under aad, returning nonce||ciphertext||tag.
+func (kv *EncryptedKVStore) seal(plaintext, aad []byte) ([]byte, error) {
+	gcm, err := kv.newGCM()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcmNonceLen)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open decrypts a nonce||ciphertext||tag block under aad.
+func (kv *EncryptedKVStore) open(blob, aad []byte) ([]byte, error) {
+	gcm, err := kv.newGCM()
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < gcmNonceLen {
+		return nil, fmt.Errorf("ciphertext too short (%d bytes)", len(blob))
+	}
+	nonce, ciphertext := blob[:gcmNonceLen], blob[gcmNonceLen:]
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
+
+func inodeAAD(key uint64) []byte {
+	var aad [8]byte
+	binary.LittleEndian.PutUint64(aad[:], key)
+	return aad[:]
+}
+
+func chunkAAD(key uint64) []byte {
+	var aad [8]byte
+	binary.LittleEndian.PutUint64(aad[:], key)
+	return aad[:]
+}
+
+// PutMetadata marshals newMeta, encrypts it with the inode number as AAD,
+// and stores the ciphertext through the wrapped KVStore.
+func (kv *EncryptedKVStore) PutMetadata(key uint64, newMeta *bangpb.InodeMeta) ([]byte, error) {
+	plain, err := proto.Marshal(newMeta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	blob, err := kv.seal(plain, inodeAAD(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt metadata: %w", err)
+	}
+	return kv.KVStore.PutMetadataBytes(key, blob)
+}
+
+// UpdateMetadata encrypts newMeta the same way as PutMetadata before the CAS
+// write, so the vclock semantics of the wrapped store are unaffected.
+func (kv *EncryptedKVStore) UpdateMetadata(key uint64, newMeta *bangpb.InodeMeta, vclockIn []byte) ([]byte, error) {
+	plain, err := proto.Marshal(newMeta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	blob, err := kv.seal(plain, inodeAAD(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt metadata: %w", err)
+	}
+	return kv.KVStore.UpdateMetadataBytes(key, blob, vclockIn)
+}
+
+// Metadata fetches and decrypts metadata for key, rejecting ciphertext that
+// was authenticated under a different inode number.
+func (kv *EncryptedKVStore) Metadata(key uint64) (*bangpb.InodeMeta, []byte, error) {
+	blob, vclock, err := kv.KVStore.MetadataBytes(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	plain, err := kv.open(blob, inodeAAD(key))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt metadata for inode %d: %w", key, err)
+	}
+	meta := &bangpb.InodeMeta{}
+	if err := proto.Unmarshal(plain, meta); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	return meta, vclock, nil
+}
+
+// PutChunk encrypts data (AAD = chunk key) before handing it to the wrapped
+// store, preserving the chunkPath layout.
+func (kv *EncryptedKVStore) PutChunk(key uint64, data []byte) error {
+	blob, err := kv.seal(data, chunkAAD(key))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt chunk %016x: %w", key, err)
+	}
+	return kv.KVStore.PutChunk(key, blob)
+}
+
+// Chunk fetches and decrypts a chunk, rejecting ciphertext authenticated
+// under a different chunk key.
+func (kv *EncryptedKVStore) Chunk(key uint64) ([]byte, error) {
+	blob, err := kv.KVStore.Chunk(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := kv.open(blob, chunkAAD(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk %016x: %w", key, err)
+	}
+	return plain, nil
+}
+
+// PutChunkClass encrypts data like PutChunk, then routes the ciphertext to
+// class's tier if the wrapped store is class-aware (see TieredKVStore),
+// falling back to the default-tier PutChunk otherwise.
+func (kv *EncryptedKVStore) PutChunkClass(class string, key uint64, data []byte) error {
+	blob, err := kv.seal(data, chunkAAD(key))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt chunk %016x: %w", key, err)
+	}
+	if cc, ok := kv.KVStore.(classAwareKVStore); ok {
+		return cc.PutChunkClass(class, key, blob)
+	}
+	return kv.KVStore.PutChunk(key, blob)
+}
+
+// ChunkClass fetches a chunk via class's tier if the wrapped store is
+// class-aware, falling back to plain Chunk otherwise, then decrypts it like
+// Chunk.
+func (kv *EncryptedKVStore) ChunkClass(class string, key uint64) ([]byte, error) {
+	var blob []byte
+	var err error
+	if cc, ok := kv.KVStore.(classAwareKVStore); ok {
+		blob, err = cc.ChunkClass(class, key)
+	} else {
+		blob, err = kv.KVStore.Chunk(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain, err := kv.open(blob, chunkAAD(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk %016x: %w", key, err)
+	}
+	return plain, nil
+}
+
+// MountEncrypted connects to a Riak backend under namespace, wraps it in an
+// EncryptedKVStore keyed off masterKey, and mounts it exactly like
+// NewBangServer/Mount. confDir is the backend root where master.conf lives.
+func MountEncrypted(host string, port uint16, namespace, confDir string, masterKey []byte, mountpoint string) (*BangServer, error) {
+	rkv, err := NewRiakKVStore(host, port, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to backend: %w", err)
+	}
+	ekv, err := NewEncryptedKVStore(rkv, confDir, masterKey)
+	if err != nil {
+		rkv.Close()
+		return nil, fmt.Errorf("failed to initialize encryption: %w", err)
+	}
+	bs, err := NewBangServerWithKV(ekv)
+	if err != nil {
+		return nil, err
+	}
+	if err := bs.Mount(mountpoint); err != nil {
+		bs.Close()
+		return nil, err
+	}
+	return bs, nil
+}
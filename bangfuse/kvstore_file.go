@@ -1,11 +1,14 @@
 package bangfuse
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,11 +23,33 @@ import (
 //	/tmp/bangfs_<namespace>/metadata/<inode>         — protobuf-encoded InodeMeta
 //	/tmp/bangfs_<namespace>/metadata/<inode>.vclock   — 8-byte little-endian version counter
 //	/tmp/bangfs_<namespace>/chunks/<hex_hash>         — raw chunk bytes
+//	/tmp/bangfs_<namespace>/dentries/<parent>/<name>  — protobuf-encoded ChildEntry (dentry mode only)
+//	/tmp/bangfs_<namespace>/dedup.conf                — single byte, dedup on/off
+//	/tmp/bangfs_<namespace>/dentry_mode.conf          — single byte, dentry-mode on/off
 type FileKVStore struct {
 	namespace   string
 	baseDir     string
 	metadataDir string
 	chunkDir    string
+	dentryDir   string
+
+	dedupMu      sync.Mutex
+	dedupLoaded  bool
+	dedupEnabled bool
+
+	dentryModeMu      sync.Mutex
+	dentryModeLoaded  bool
+	dentryModeEnabled bool
+}
+
+func init() {
+	RegisterBackend("file", func(dsn string) (KVStore, error) {
+		namespace := strings.TrimPrefix(dsn, "file:")
+		if namespace == "" {
+			return nil, fmt.Errorf("invalid file dsn %q: expected file:<namespace>", dsn)
+		}
+		return NewFileKVStore(namespace)
+	})
 }
 
 func NewFileKVStore(namespace string) (*FileKVStore, error) {
@@ -34,6 +59,7 @@ func NewFileKVStore(namespace string) (*FileKVStore, error) {
 		baseDir:     base,
 		metadataDir: filepath.Join(base, "metadata"),
 		chunkDir:    filepath.Join(base, "chunks"),
+		dentryDir:   filepath.Join(base, "dentries"),
 	}
 	if err := os.MkdirAll(kv.metadataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create metadata dir: %w", err)
@@ -92,6 +118,176 @@ func (kv *FileKVStore) chunkPath(key uint64) string {
 	return filepath.Join(kv.chunkDir, fmt.Sprintf("%016x", key))
 }
 
+func (kv *FileKVStore) refcountPath(key uint64) string {
+	return filepath.Join(kv.chunkDir, fmt.Sprintf("%016x.refcount", key))
+}
+
+func (kv *FileKVStore) dedupConfPath() string {
+	return filepath.Join(kv.baseDir, "dedup.conf")
+}
+
+func (kv *FileKVStore) dentryModeConfPath() string {
+	return filepath.Join(kv.baseDir, "dentry_mode.conf")
+}
+
+func (kv *FileKVStore) dentryParentDir(parent uint64) string {
+	return filepath.Join(kv.dentryDir, fmt.Sprintf("%d", parent))
+}
+
+// SetDedupEnabled persists whether PutChunk should dedup by content key.
+func (kv *FileKVStore) SetDedupEnabled(enabled bool) error {
+	value := byte(0)
+	if enabled {
+		value = 1
+	}
+	if err := os.WriteFile(kv.dedupConfPath(), []byte{value}, 0644); err != nil {
+		return fmt.Errorf("failed to write dedup.conf: %w", err)
+	}
+	kv.dedupMu.Lock()
+	kv.dedupLoaded = true
+	kv.dedupEnabled = enabled
+	kv.dedupMu.Unlock()
+	return nil
+}
+
+// DedupEnabled reports the current dedup setting, defaulting to true (the
+// behavior before this was configurable) if dedup.conf hasn't been written.
+func (kv *FileKVStore) DedupEnabled() (bool, error) {
+	kv.dedupMu.Lock()
+	if kv.dedupLoaded {
+		defer kv.dedupMu.Unlock()
+		return kv.dedupEnabled, nil
+	}
+	kv.dedupMu.Unlock()
+
+	enabled := true
+	if data, err := os.ReadFile(kv.dedupConfPath()); err == nil && len(data) > 0 {
+		enabled = data[0] != 0
+	}
+
+	kv.dedupMu.Lock()
+	kv.dedupLoaded = true
+	kv.dedupEnabled = enabled
+	kv.dedupMu.Unlock()
+	return enabled, nil
+}
+
+// SetDentryMode persists whether a directory's children are stored as
+// individual dentry files under dentries/<parent>/ instead of being
+// embedded in the parent's ChildEntries.
+func (kv *FileKVStore) SetDentryMode(enabled bool) error {
+	value := byte(0)
+	if enabled {
+		value = 1
+	}
+	if err := os.WriteFile(kv.dentryModeConfPath(), []byte{value}, 0644); err != nil {
+		return fmt.Errorf("failed to write dentry_mode.conf: %w", err)
+	}
+	kv.dentryModeMu.Lock()
+	kv.dentryModeLoaded = true
+	kv.dentryModeEnabled = enabled
+	kv.dentryModeMu.Unlock()
+	return nil
+}
+
+// DentryMode reports the current dentry-mode setting, defaulting to false
+// (embedded ChildEntries) if dentry_mode.conf hasn't been written.
+func (kv *FileKVStore) DentryMode() (bool, error) {
+	kv.dentryModeMu.Lock()
+	if kv.dentryModeLoaded {
+		defer kv.dentryModeMu.Unlock()
+		return kv.dentryModeEnabled, nil
+	}
+	kv.dentryModeMu.Unlock()
+
+	enabled := false
+	if data, err := os.ReadFile(kv.dentryModeConfPath()); err == nil && len(data) > 0 {
+		enabled = data[0] != 0
+	}
+
+	kv.dentryModeMu.Lock()
+	kv.dentryModeLoaded = true
+	kv.dentryModeEnabled = enabled
+	kv.dentryModeMu.Unlock()
+	return enabled, nil
+}
+
+// PutDentry stores entry as its own small file under dentries/<parent>/<name>.
+func (kv *FileKVStore) PutDentry(parent uint64, entry *bangpb.ChildEntry) error {
+	dir := kv.dentryParentDir(parent)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create dentry dir: %w", err)
+	}
+	data, err := proto.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dentry: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, entry.Name), data, 0644); err != nil {
+		return fmt.Errorf("failed to write dentry: %w", err)
+	}
+	return nil
+}
+
+// DeleteDentry removes the dentry file for name under parent. A no-op if
+// it doesn't exist.
+func (kv *FileKVStore) DeleteDentry(parent uint64, name string) error {
+	if err := os.Remove(filepath.Join(kv.dentryParentDir(parent), name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete dentry: %w", err)
+	}
+	return nil
+}
+
+// ListChildren lists parent's dentry directory and unmarshals each file.
+func (kv *FileKVStore) ListChildren(parent uint64) ([]*bangpb.ChildEntry, error) {
+	entries, err := os.ReadDir(kv.dentryParentDir(parent))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read dentry dir: %w", err)
+	}
+	children := make([]*bangpb.ChildEntry, 0, len(entries))
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(kv.dentryParentDir(parent), e.Name()))
+		if err != nil {
+			continue // raced with a concurrent delete; just skip it
+		}
+		entry := &bangpb.ChildEntry{}
+		if err := proto.Unmarshal(data, entry); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal dentry %s: %w", e.Name(), err)
+		}
+		children = append(children, entry)
+	}
+	return children, nil
+}
+
+// readChunkRefcount reads the refcount for key, treating a missing
+// refcount file as 0 (i.e. not present).
+func (kv *FileKVStore) readChunkRefcount(key uint64) uint64 {
+	data, err := os.ReadFile(kv.refcountPath(key))
+	if err != nil || len(data) != 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(data)
+}
+
+// bumpChunkRefcount applies delta to key's refcount file and returns the
+// resulting value. FileKVStore is a single-process dev/test backend, so
+// this plain read-modify-write is fine; it has no concurrent-writer story
+// to protect against, same as bumpVclock below.
+func (kv *FileKVStore) bumpChunkRefcount(key uint64, delta int64) (uint64, error) {
+	count := int64(kv.readChunkRefcount(key)) + delta
+	if count < 0 {
+		count = 0
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(count))
+	if err := os.WriteFile(kv.refcountPath(key), buf, 0644); err != nil {
+		return 0, fmt.Errorf("failed to write refcount: %w", err)
+	}
+	return uint64(count), nil
+}
+
 // readVclock reads the current vclock (version counter) for a metadata key.
 func (kv *FileKVStore) readVclock(key uint64) ([]byte, error) {
 	data, err := os.ReadFile(kv.vclockPath(key))
@@ -119,15 +315,21 @@ func (kv *FileKVStore) bumpVclock(key uint64) ([]byte, error) {
 // Metadata CRUD
 
 func (kv *FileKVStore) PutMetadata(key uint64, newMeta *bangpb.InodeMeta) ([]byte, error) {
-	// Fail if key already exists (matches Riak IfNoneMatch behavior)
-	if _, err := os.Stat(kv.metaPath(key)); err == nil {
-		return nil, fmt.Errorf("key already exists: %d", key)
-	}
-
 	data, err := proto.Marshal(newMeta)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
 	}
+	return kv.PutMetadataBytes(key, data)
+}
+
+// PutMetadataBytes is the byte-level counterpart of PutMetadata: it skips
+// the marshalling step so decorators can substitute a transformed blob
+// (e.g. ciphertext) while keeping the same CAS semantics.
+func (kv *FileKVStore) PutMetadataBytes(key uint64, data []byte) ([]byte, error) {
+	// Fail if key already exists (matches Riak IfNoneMatch behavior)
+	if _, err := os.Stat(kv.metaPath(key)); err == nil {
+		return nil, fmt.Errorf("key already exists: %d", key)
+	}
 
 	if err := os.WriteFile(kv.metaPath(key), data, 0644); err != nil {
 		return nil, fmt.Errorf("failed to write metadata: %w", err)
@@ -141,9 +343,9 @@ func (kv *FileKVStore) PutMetadata(key uint64, newMeta *bangpb.InodeMeta) ([]byt
 }
 
 func (kv *FileKVStore) Metadata(key uint64) (*bangpb.InodeMeta, []byte, error) {
-	data, err := os.ReadFile(kv.metaPath(key))
+	data, vclock, err := kv.MetadataBytes(key)
 	if err != nil {
-		return nil, nil, fmt.Errorf("key not found: %d", key)
+		return nil, nil, err
 	}
 
 	meta := &bangpb.InodeMeta{}
@@ -151,15 +353,35 @@ func (kv *FileKVStore) Metadata(key uint64) (*bangpb.InodeMeta, []byte, error) {
 		return nil, nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
 	}
 
+	return meta, vclock, nil
+}
+
+// MetadataBytes is the byte-level counterpart of Metadata: it returns the
+// raw stored value instead of unmarshalling it into a *bangpb.InodeMeta.
+func (kv *FileKVStore) MetadataBytes(key uint64) ([]byte, []byte, error) {
+	data, err := os.ReadFile(kv.metaPath(key))
+	if err != nil {
+		return nil, nil, fmt.Errorf("key not found: %d", key)
+	}
+
 	vclock, err := kv.readVclock(key)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to read vclock: %w", err)
 	}
 
-	return meta, vclock, nil
+	return data, vclock, nil
 }
 
 func (kv *FileKVStore) UpdateMetadata(key uint64, newMeta *bangpb.InodeMeta, vclockIn []byte) ([]byte, error) {
+	data, err := proto.Marshal(newMeta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	return kv.UpdateMetadataBytes(key, data, vclockIn)
+}
+
+// UpdateMetadataBytes is the byte-level counterpart of UpdateMetadata.
+func (kv *FileKVStore) UpdateMetadataBytes(key uint64, data []byte, vclockIn []byte) ([]byte, error) {
 	// Check vclock matches (simulates Riak IfNotModified)
 	current, err := kv.readVclock(key)
 	if err != nil {
@@ -169,15 +391,10 @@ func (kv *FileKVStore) UpdateMetadata(key uint64, newMeta *bangpb.InodeMeta, vcl
 		want := binary.LittleEndian.Uint64(vclockIn)
 		have := binary.LittleEndian.Uint64(current)
 		if want != have {
-			return nil, fmt.Errorf("vclock mismatch: expected %d, got %d (concurrent modification)", want, have)
+			return nil, fmt.Errorf("%w: expected %d, got %d", ErrVClockConflict, want, have)
 		}
 	}
 
-	data, err := proto.Marshal(newMeta)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
-	}
-
 	if err := os.WriteFile(kv.metaPath(key), data, 0644); err != nil {
 		return nil, fmt.Errorf("failed to write metadata: %w", err)
 	}
@@ -213,10 +430,33 @@ func (kv *FileKVStore) DeleteMetadata(key uint64, vclockIn []byte) error {
 
 // Chunk CRUD
 
+// PutChunk writes data under key, or if key already exists, skips the
+// write and just records another reference to it (content-addressed
+// dedup: identical content always hashes to the same key).
 func (kv *FileKVStore) PutChunk(key uint64, data []byte) error {
+	dedup, err := kv.DedupEnabled()
+	if err != nil {
+		return fmt.Errorf("failed to load dedup setting: %w", err)
+	}
+	if _, err := os.Stat(kv.chunkPath(key)); err == nil {
+		if dedup {
+			_, err := kv.bumpChunkRefcount(key, 1)
+			return err
+		}
+		// Dedup off: a repeat PutChunk at the same key rewrites the bytes
+		// and, like the first put, adds a reference.
+		if err := os.WriteFile(kv.chunkPath(key), data, 0644); err != nil {
+			return fmt.Errorf("failed to write chunk: %w", err)
+		}
+		_, err := kv.bumpChunkRefcount(key, 1)
+		return err
+	}
 	if err := os.WriteFile(kv.chunkPath(key), data, 0644); err != nil {
 		return fmt.Errorf("failed to write chunk: %w", err)
 	}
+	if _, err := kv.bumpChunkRefcount(key, 1); err != nil {
+		return fmt.Errorf("failed to seed refcount: %w", err)
+	}
 	return nil
 }
 
@@ -228,31 +468,156 @@ func (kv *FileKVStore) Chunk(key uint64) ([]byte, error) {
 	return data, nil
 }
 
+// DeleteChunk releases one reference to the chunk at key, physically
+// removing the bytes (and refcount file) only once the count reaches zero.
 func (kv *FileKVStore) DeleteChunk(key uint64) error {
+	remaining, err := kv.bumpChunkRefcount(key, -1)
+	if err != nil {
+		return fmt.Errorf("failed to decrement refcount: %w", err)
+	}
+	if remaining > 0 {
+		return nil
+	}
+	os.Remove(kv.refcountPath(key))
 	if err := os.Remove(kv.chunkPath(key)); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to delete chunk: %w", err)
 	}
 	return nil
 }
 
-// WipeBackend deletes all keys (files) in the metadata and chunk directories.
-func (kv *FileKVStore) WipeBackend() error {
-	for _, dir := range []string{kv.metadataDir, kv.chunkDir} {
-		if !strings.HasPrefix(dir, "/tmp/") {
-			return fmt.Errorf("refusing to wipe %q: not under /tmp", kv.baseDir)
+// ChunkRefCount reports the current reference count for key, or 0 if it
+// has never been written (or was already GC'd down to zero).
+func (kv *FileKVStore) ChunkRefCount(key uint64) (uint64, error) {
+	return kv.readChunkRefcount(key), nil
+}
+
+// ListKeys streams the filenames in bucket's directory to ch (skipping the
+// .vclock/.refcount sidecar files), closing ch when done or ctx is
+// cancelled. Local disk reads are cheap, so unlike RiakKVStore this just
+// lists the directory up front rather than paging it.
+func (kv *FileKVStore) ListKeys(ctx context.Context, bucket string, ch chan<- string) error {
+	defer close(ch)
+
+	var dir string
+	switch bucket {
+	case metadataBucket:
+		dir = kv.metadataDir
+	case chunkBucket:
+		dir = kv.chunkDir
+	default:
+		return fmt.Errorf("unknown bucket %q", bucket)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
-		entries, err := os.ReadDir(dir)
-		if err != nil {
-			if os.IsNotExist(err) {
-				continue
-			}
-			return fmt.Errorf("failed to read dir %s: %w", dir, err)
+		return fmt.Errorf("failed to read dir %s: %w", dir, err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".vclock") || strings.HasSuffix(name, ".refcount") {
+			continue
+		}
+		select {
+		case ch <- name:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		for _, e := range entries {
-			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
-				return fmt.Errorf("failed to delete %s: %w", e.Name(), err)
+	}
+	return nil
+}
+
+// WipeBackendCtx deletes all keys in the metadata and chunk buckets,
+// streaming them via ListKeys and honoring ctx cancellation. opts.Workers is
+// accepted for interface parity with RiakKVStore but unused: FileKVStore's
+// single-process dev/test backend has no coverage-query cost to amortize
+// with concurrency.
+func (kv *FileKVStore) WipeBackendCtx(ctx context.Context, w io.Writer, opts WipeOptions) error {
+	for _, b := range []struct {
+		bucket, dir string
+	}{
+		{metadataBucket, kv.metadataDir},
+		{chunkBucket, kv.chunkDir},
+	} {
+		fmt.Fprintf(w, "  wiping %s [%s]...\n", b.bucket, b.dir)
+		keys := make(chan string)
+		listDone := make(chan error, 1)
+		go func(bucket string) { listDone <- kv.ListKeys(ctx, bucket, keys) }(b.bucket)
+
+		n := 0
+		for key := range keys {
+			if err := kv.deleteBucketKey(b.bucket, key); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", key, err)
 			}
+			n++
+		}
+		if err := <-listDone; err != nil {
+			return fmt.Errorf("failed to list %s keys: %w", b.bucket, err)
+		}
+		fmt.Fprintf(w, "  deleted %d keys from %s\n", n, b.bucket)
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 	}
+
+	// Dentries are nested under dentries/<parent>/<name>, which doesn't fit
+	// ListKeys's flat-directory assumption, so wipe the whole subtree directly.
+	n, err := countFiles(kv.dentryDir)
+	if err != nil {
+		return fmt.Errorf("failed to count dentries: %w", err)
+	}
+	if err := os.RemoveAll(kv.dentryDir); err != nil {
+		return fmt.Errorf("failed to wipe dentries: %w", err)
+	}
+	fmt.Fprintf(w, "  deleted %d keys from %s\n", n, dentryBucket)
 	return nil
 }
+
+// countFiles counts the regular files nested anywhere under dir, or 0 if
+// dir doesn't exist.
+func countFiles(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	count := 0
+	for _, e := range entries {
+		if e.IsDir() {
+			sub, err := countFiles(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return 0, err
+			}
+			count += sub
+		} else {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// deleteBucketKey removes the file(s) backing key in bucket, including its
+// sidecar vclock/refcount file if any.
+func (kv *FileKVStore) deleteBucketKey(bucket, key string) error {
+	switch bucket {
+	case metadataBucket:
+		os.Remove(filepath.Join(kv.metadataDir, key+".vclock"))
+		return os.Remove(filepath.Join(kv.metadataDir, key))
+	case chunkBucket:
+		os.Remove(filepath.Join(kv.chunkDir, key+".refcount"))
+		return os.Remove(filepath.Join(kv.chunkDir, key))
+	default:
+		return fmt.Errorf("unknown bucket %q", bucket)
+	}
+}
+
+// WipeBackend deletes all metadata, chunks, and dentries from the backend —
+// the file-backed counterpart to RiakKVStore.WipeBackend — by delegating to
+// WipeBackendCtx with a background context and the default wipe options.
+func (kv *FileKVStore) WipeBackend(w io.Writer) error {
+	return kv.WipeBackendCtx(context.Background(), w, DefaultWipeOptions())
+}
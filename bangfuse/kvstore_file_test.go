@@ -1,6 +1,7 @@
 package bangfuse
 
 import (
+	"io"
 	"testing"
 )
 
@@ -20,7 +21,7 @@ func testFileKV(t *testing.T) KVStore {
 		t.Fatalf("Connect: %v", err)
 	}
 	t.Cleanup(func() {
-		kv.WipeBackend()
+		kv.WipeBackend(io.Discard)
 		kv.Close()
 	})
 
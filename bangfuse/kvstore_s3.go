@@ -0,0 +1,654 @@
+package bangfuse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"google.golang.org/protobuf/proto"
+
+	bangpb "bangfs/proto"
+)
+
+func init() {
+	RegisterBackend("s3", func(dsn string) (KVStore, error) {
+		return NewS3KVStore(dsn)
+	})
+}
+
+const s3MetadataPrefix = "metadata/"
+const s3ChunkPrefix = "chunks/"
+const s3DentryPrefix = "dentries/"
+const s3DedupConfigKey = "_dedup_config"
+const s3DentryModeConfigKey = "_dentry_mode"
+
+// S3KVStore implements KVStore on an S3 (or S3-compatible) bucket. There's
+// no vclock in S3, so CAS is done via ETag: UpdateMetadata passes the
+// previously-read ETag as an If-Match precondition, and PutMetadata
+// (creation) uses If-None-Match: "*", same idea as RiakKVStore's
+// WithIfNotModified/WithIfNoneMatch.
+type S3KVStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+
+	dedupMu      sync.Mutex
+	dedupLoaded  bool
+	dedupEnabled bool
+
+	dentryModeMu      sync.Mutex
+	dentryModeLoaded  bool
+	dentryModeEnabled bool
+}
+
+// NewS3KVStore parses dsn (e.g. "s3://bucket/prefix?region=us-east-1") and
+// opens an S3 client using the default AWS credential chain.
+func NewS3KVStore(dsn string) (*S3KVStore, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 dsn %q: expected s3://bucket/prefix?region=...", dsn)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	kv := &S3KVStore{
+		bucket: u.Host,
+		prefix: prefix,
+	}
+
+	var opts []func(*config.LoadOptions) error
+	if region := u.Query().Get("region"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	kv.client = s3.NewFromConfig(cfg)
+	return kv, nil
+}
+
+// Connect is a no-op: the S3 SDK client is stateless, so there's no
+// persistent connection to (re)establish.
+func (kv *S3KVStore) Connect() error {
+	return nil
+}
+
+func (kv *S3KVStore) Close() error {
+	return nil
+}
+
+func (kv *S3KVStore) metaKey(key uint64) string {
+	return fmt.Sprintf("%s%s%d", kv.prefix, s3MetadataPrefix, key)
+}
+
+func (kv *S3KVStore) chunkKey(key uint64) string {
+	return fmt.Sprintf("%s%s%016x", kv.prefix, s3ChunkPrefix, key)
+}
+
+func (kv *S3KVStore) refcountKey(key uint64) string {
+	return kv.chunkKey(key) + ".refcount"
+}
+
+func (kv *S3KVStore) dedupConfigObjKey() string {
+	return kv.prefix + s3DedupConfigKey
+}
+
+func (kv *S3KVStore) dentryModeConfigObjKey() string {
+	return kv.prefix + s3DentryModeConfigKey
+}
+
+func (kv *S3KVStore) dentryObjKey(parent uint64, name string) string {
+	return fmt.Sprintf("%s%s%d/%s", kv.prefix, s3DentryPrefix, parent, name)
+}
+
+func (kv *S3KVStore) dentryParentPrefix(parent uint64) string {
+	return fmt.Sprintf("%s%s%d/", kv.prefix, s3DentryPrefix, parent)
+}
+
+// InitBackend creates the root inode (inode 0), same contract as
+// RiakKVStore.InitBackend/FileKVStore.InitBackend.
+func (kv *S3KVStore) InitBackend() error {
+	existing, _, err := kv.Metadata(0)
+	if err == nil && existing != nil {
+		return fmt.Errorf("filesystem already exists (inode 0 found under s3://%s/%s). Use WipeBackend() first to reinitialize", kv.bucket, kv.prefix)
+	}
+
+	now := time.Now().UnixNano()
+	rootDir := &bangpb.InodeMeta{
+		Name: "", ParentInode: 0,
+		Mode:         0755 | syscall.S_IFDIR,
+		CtimeNs:      now,
+		MtimeNs:      now,
+		AtimeNs:      now,
+		ChildEntries: []*bangpb.ChildEntry{},
+		Nlink:        2,
+	}
+	_, err = kv.PutMetadata(0, rootDir)
+	return err
+}
+
+func (kv *S3KVStore) PutMetadata(key uint64, newMeta *bangpb.InodeMeta) ([]byte, error) {
+	data, err := proto.Marshal(newMeta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	return kv.PutMetadataBytes(key, data)
+}
+
+func (kv *S3KVStore) PutMetadataBytes(key uint64, data []byte) ([]byte, error) {
+	out, err := kv.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:      aws.String(kv.bucket),
+		Key:         aws.String(kv.metaKey(key)),
+		Body:        bytes.NewReader(data),
+		IfNoneMatch: aws.String("*"), // fail if an object already exists at this key
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to put metadata (key %d may already exist): %w", key, err)
+	}
+	if out.ETag == nil {
+		return nil, fmt.Errorf("didn't get ETag back from S3")
+	}
+	return []byte(*out.ETag), nil
+}
+
+func (kv *S3KVStore) Metadata(key uint64) (*bangpb.InodeMeta, []byte, error) {
+	data, etag, err := kv.MetadataBytes(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &bangpb.InodeMeta{}
+	if err := proto.Unmarshal(data, meta); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	return meta, etag, nil
+}
+
+func (kv *S3KVStore) MetadataBytes(key uint64) ([]byte, []byte, error) {
+	out, err := kv.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(kv.metaKey(key)),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("key not found: %d", key)
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	if out.ETag == nil {
+		return nil, nil, fmt.Errorf("didn't get ETag back from S3")
+	}
+	return data, []byte(*out.ETag), nil
+}
+
+func (kv *S3KVStore) UpdateMetadata(key uint64, newMeta *bangpb.InodeMeta, vclockIn []byte) ([]byte, error) {
+	data, err := proto.Marshal(newMeta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	return kv.UpdateMetadataBytes(key, data, vclockIn)
+}
+
+func (kv *S3KVStore) UpdateMetadataBytes(key uint64, data []byte, vclockIn []byte) ([]byte, error) {
+	out, err := kv.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:  aws.String(kv.bucket),
+		Key:     aws.String(kv.metaKey(key)),
+		Body:    bytes.NewReader(data),
+		IfMatch: aws.String(string(vclockIn)), // CAS: only overwrite if the ETag still matches
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+			return nil, fmt.Errorf("%w: %v", ErrVClockConflict, err)
+		}
+		return nil, fmt.Errorf("failed to update metadata: %w", err)
+	}
+	if out.ETag == nil {
+		return nil, fmt.Errorf("didn't get ETag back from S3")
+	}
+	return []byte(*out.ETag), nil
+}
+
+// DeleteMetadata deletes the object at key. Note: S3's DeleteObject has no
+// If-Match precondition in the base API, so vclockIn isn't enforced here
+// the way it is for UpdateMetadataBytes — this mirrors a real limitation of
+// S3 as a CAS-capable store rather than papering over it.
+func (kv *S3KVStore) DeleteMetadata(key uint64, vclockIn []byte) error {
+	if _, err := kv.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(kv.metaKey(key)),
+	}); err != nil {
+		return fmt.Errorf("failed to delete metadata: %w", err)
+	}
+	return nil
+}
+
+// PutChunk stores a chunk by its content-addressed key, matching the
+// Riak/File/SQLite backends' dedup-aware semantics (see KVStore.PutChunk).
+func (kv *S3KVStore) PutChunk(key uint64, data []byte) error {
+	dedup, err := kv.DedupEnabled()
+	if err != nil {
+		return fmt.Errorf("failed to load dedup setting: %w", err)
+	}
+	if dedup {
+		if _, err := kv.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+			Bucket: aws.String(kv.bucket),
+			Key:    aws.String(kv.chunkKey(key)),
+		}); err == nil {
+			_, err := kv.bumpChunkRefcount(key, 1)
+			return err
+		}
+	}
+	if _, err := kv.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(kv.chunkKey(key)),
+		Body:   bytes.NewReader(data),
+	}); err != nil {
+		return fmt.Errorf("failed to put chunk: %w", err)
+	}
+	if _, err := kv.bumpChunkRefcount(key, 1); err != nil {
+		return fmt.Errorf("failed to seed refcount: %w", err)
+	}
+	return nil
+}
+
+func (kv *S3KVStore) Chunk(key uint64) ([]byte, error) {
+	out, err := kv.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(kv.chunkKey(key)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("chunk not found: %016x", key)
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	return data, nil
+}
+
+// DeleteChunk releases one reference to the chunk at key, physically
+// removing it (and its refcount object) only once the count reaches zero.
+func (kv *S3KVStore) DeleteChunk(key uint64) error {
+	remaining, err := kv.bumpChunkRefcount(key, -1)
+	if err != nil {
+		return fmt.Errorf("failed to decrement refcount: %w", err)
+	}
+	if remaining > 0 {
+		return nil
+	}
+	ctx := context.Background()
+	kv.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(kv.bucket), Key: aws.String(kv.refcountKey(key))})
+	if _, err := kv.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(kv.bucket), Key: aws.String(kv.chunkKey(key))}); err != nil {
+		return fmt.Errorf("failed to delete chunk: %w", err)
+	}
+	return nil
+}
+
+// ChunkRefCount reports the current reference count for key, or 0 if it
+// has never been written (or was already GC'd down to zero).
+func (kv *S3KVStore) ChunkRefCount(key uint64) (uint64, error) {
+	out, err := kv.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(kv.refcountKey(key)),
+	})
+	if err != nil {
+		return 0, nil
+	}
+	defer out.Body.Close()
+	b, err := io.ReadAll(out.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read refcount: %w", err)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || n < 0 {
+		return 0, nil
+	}
+	return uint64(n), nil
+}
+
+// bumpChunkRefcount applies delta to key's refcount object and returns the
+// resulting value. S3 has no atomic counter primitive, so this does an
+// ETag-guarded read-modify-write retry loop instead, the same CAS idea as
+// UpdateMetadataBytes applied to a plain integer.
+func (kv *S3KVStore) bumpChunkRefcount(key uint64, delta int64) (int64, error) {
+	ctx := context.Background()
+	const maxAttempts = 10
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		var current int64
+		var etag *string
+		out, err := kv.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(kv.bucket), Key: aws.String(kv.refcountKey(key))})
+		if err == nil {
+			b, rerr := io.ReadAll(out.Body)
+			out.Body.Close()
+			if rerr != nil {
+				return 0, fmt.Errorf("failed to read refcount: %w", rerr)
+			}
+			current, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+			etag = out.ETag
+		}
+
+		next := current + delta
+		if next < 0 {
+			next = 0
+		}
+
+		putIn := &s3.PutObjectInput{
+			Bucket: aws.String(kv.bucket),
+			Key:    aws.String(kv.refcountKey(key)),
+			Body:   strings.NewReader(strconv.FormatInt(next, 10)),
+		}
+		if etag != nil {
+			putIn.IfMatch = etag
+		} else {
+			putIn.IfNoneMatch = aws.String("*")
+		}
+		if _, err := kv.client.PutObject(ctx, putIn); err != nil {
+			continue // lost the race to a concurrent writer; retry with a fresh read
+		}
+		return next, nil
+	}
+	return 0, fmt.Errorf("failed to update refcount for chunk %016x: too much contention", key)
+}
+
+func (kv *S3KVStore) SetDedupEnabled(enabled bool) error {
+	value := "0"
+	if enabled {
+		value = "1"
+	}
+	if _, err := kv.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(kv.dedupConfigObjKey()),
+		Body:   strings.NewReader(value),
+	}); err != nil {
+		return fmt.Errorf("failed to write dedup setting: %w", err)
+	}
+	kv.dedupMu.Lock()
+	kv.dedupLoaded = true
+	kv.dedupEnabled = enabled
+	kv.dedupMu.Unlock()
+	return nil
+}
+
+func (kv *S3KVStore) DedupEnabled() (bool, error) {
+	kv.dedupMu.Lock()
+	if kv.dedupLoaded {
+		defer kv.dedupMu.Unlock()
+		return kv.dedupEnabled, nil
+	}
+	kv.dedupMu.Unlock()
+
+	enabled := true
+	out, err := kv.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(kv.dedupConfigObjKey()),
+	})
+	if err == nil {
+		b, rerr := io.ReadAll(out.Body)
+		out.Body.Close()
+		if rerr == nil && len(b) > 0 {
+			enabled = strings.TrimSpace(string(b)) != "0"
+		}
+	}
+
+	kv.dedupMu.Lock()
+	kv.dedupLoaded = true
+	kv.dedupEnabled = enabled
+	kv.dedupMu.Unlock()
+	return enabled, nil
+}
+
+// SetDentryMode persists whether a directory's children are stored as
+// individual dentry objects under the dentries/ prefix instead of being
+// embedded in the parent's ChildEntries.
+func (kv *S3KVStore) SetDentryMode(enabled bool) error {
+	value := "0"
+	if enabled {
+		value = "1"
+	}
+	if _, err := kv.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(kv.dentryModeConfigObjKey()),
+		Body:   strings.NewReader(value),
+	}); err != nil {
+		return fmt.Errorf("failed to write dentry mode setting: %w", err)
+	}
+	kv.dentryModeMu.Lock()
+	kv.dentryModeLoaded = true
+	kv.dentryModeEnabled = enabled
+	kv.dentryModeMu.Unlock()
+	return nil
+}
+
+// DentryMode reports the current dentry-mode setting, defaulting to false
+// (embedded ChildEntries) if it was never explicitly set.
+func (kv *S3KVStore) DentryMode() (bool, error) {
+	kv.dentryModeMu.Lock()
+	if kv.dentryModeLoaded {
+		defer kv.dentryModeMu.Unlock()
+		return kv.dentryModeEnabled, nil
+	}
+	kv.dentryModeMu.Unlock()
+
+	enabled := false
+	out, err := kv.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(kv.dentryModeConfigObjKey()),
+	})
+	if err == nil {
+		b, rerr := io.ReadAll(out.Body)
+		out.Body.Close()
+		if rerr == nil && len(b) > 0 {
+			enabled = strings.TrimSpace(string(b)) != "0"
+		}
+	}
+
+	kv.dentryModeMu.Lock()
+	kv.dentryModeLoaded = true
+	kv.dentryModeEnabled = enabled
+	kv.dentryModeMu.Unlock()
+	return enabled, nil
+}
+
+// PutDentry stores (or overwrites) entry as its own small object under
+// dentries/<parent>/<name>.
+func (kv *S3KVStore) PutDentry(parent uint64, entry *bangpb.ChildEntry) error {
+	data, err := proto.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dentry: %w", err)
+	}
+	if _, err := kv.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(kv.dentryObjKey(parent, entry.Name)),
+		Body:   bytes.NewReader(data),
+	}); err != nil {
+		return fmt.Errorf("failed to put dentry: %w", err)
+	}
+	return nil
+}
+
+// DeleteDentry removes the object at dentries/<parent>/<name>.
+func (kv *S3KVStore) DeleteDentry(parent uint64, name string) error {
+	if _, err := kv.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(kv.bucket),
+		Key:    aws.String(kv.dentryObjKey(parent, name)),
+	}); err != nil {
+		return fmt.Errorf("failed to delete dentry: %w", err)
+	}
+	return nil
+}
+
+// ListChildren lists every object under dentries/<parent>/, the S3
+// equivalent of RiakKVStore's parent_inode_int 2i range query.
+func (kv *S3KVStore) ListChildren(parent uint64) ([]*bangpb.ChildEntry, error) {
+	ctx := context.Background()
+	prefix := kv.dentryParentPrefix(parent)
+	paginator := s3.NewListObjectsV2Paginator(kv.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(kv.bucket),
+		Prefix: aws.String(prefix),
+	})
+	var children []*bangpb.ChildEntry
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list dentries under %s: %w", prefix, err)
+		}
+		for _, obj := range page.Contents {
+			if obj.Key == nil {
+				continue
+			}
+			out, err := kv.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(kv.bucket), Key: obj.Key})
+			if err != nil {
+				continue // raced with a concurrent delete; just skip it
+			}
+			data, rerr := io.ReadAll(out.Body)
+			out.Body.Close()
+			if rerr != nil {
+				return nil, fmt.Errorf("failed to read dentry %s: %w", *obj.Key, rerr)
+			}
+			entry := &bangpb.ChildEntry{}
+			if err := proto.Unmarshal(data, entry); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal dentry %s: %w", *obj.Key, err)
+			}
+			children = append(children, entry)
+		}
+	}
+	return children, nil
+}
+
+// WipeBackend deletes all objects under the metadata and chunk prefixes.
+func (kv *S3KVStore) WipeBackend(w io.Writer) error {
+	return kv.WipeBackendCtx(context.Background(), w, DefaultWipeOptions())
+}
+
+// keyPrefixFor resolves one of the package-level bucket name constants to
+// this store's S3 key prefix.
+func (kv *S3KVStore) keyPrefixFor(bucket string) (string, error) {
+	switch bucket {
+	case metadataBucket:
+		return kv.prefix + s3MetadataPrefix, nil
+	case chunkBucket:
+		return kv.prefix + s3ChunkPrefix, nil
+	case dentryBucket:
+		return kv.prefix + s3DentryPrefix, nil
+	default:
+		return "", fmt.Errorf("unknown bucket %q", bucket)
+	}
+}
+
+// ListKeys streams the object keys under bucket's prefix to ch, paginating
+// through ListObjectsV2 so a namespace can exceed one page of results
+// without being materialized all at once. Closes ch when done or ctx is
+// cancelled.
+func (kv *S3KVStore) ListKeys(ctx context.Context, bucket string, ch chan<- string) error {
+	defer close(ch)
+
+	prefix, err := kv.keyPrefixFor(bucket)
+	if err != nil {
+		return err
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(kv.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(kv.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list objects under %s: %w", prefix, err)
+		}
+		for _, obj := range page.Contents {
+			if obj.Key == nil || strings.HasSuffix(*obj.Key, ".refcount") {
+				continue
+			}
+			select {
+			case ch <- strings.TrimPrefix(*obj.Key, prefix):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// WipeBackendCtx deletes every object under the metadata and chunk
+// prefixes, streaming keys via ListKeys and issuing deletes through a
+// bounded pool of opts.Workers goroutines — an S3 bucket listing can be
+// just as large as a Riak bucket, so the same concurrency concern applies.
+func (kv *S3KVStore) WipeBackendCtx(ctx context.Context, w io.Writer, opts WipeOptions) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultWipeOptions().Workers
+	}
+
+	for _, bucket := range []string{metadataBucket, chunkBucket, dentryBucket} {
+		prefix, _ := kv.keyPrefixFor(bucket)
+		fmt.Fprintf(w, "  wiping %s [s3://%s/%s]...\n", bucket, kv.bucket, prefix)
+		n, err := kv.wipeBucketStreamed(ctx, bucket, prefix, workers)
+		if err != nil {
+			return fmt.Errorf("failed to wipe %s: %w", bucket, err)
+		}
+		fmt.Fprintf(w, "  deleted %d keys from %s\n", n, bucket)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (kv *S3KVStore) wipeBucketStreamed(ctx context.Context, bucket, prefix string, workers int) (int, error) {
+	keys := make(chan string, workers*4)
+	listDone := make(chan error, 1)
+	go func() { listDone <- kv.ListKeys(ctx, bucket, keys) }()
+
+	var deleted int64
+	var firstErr error
+	var errMu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				if ctx.Err() != nil {
+					continue
+				}
+				if bucket == chunkBucket {
+					kv.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(kv.bucket), Key: aws.String(prefix + key + ".refcount")})
+				}
+				if _, err := kv.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(kv.bucket), Key: aws.String(prefix + key)}); err != nil {
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("failed to delete %s: %w", prefix+key, err)
+					}
+					errMu.Unlock()
+					continue
+				}
+				atomic.AddInt64(&deleted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := <-listDone; err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return int(atomic.LoadInt64(&deleted)), firstErr
+}
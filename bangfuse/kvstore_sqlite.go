@@ -0,0 +1,490 @@
+package bangfuse
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	_ "modernc.org/sqlite"
+
+	bangpb "bangfs/proto"
+)
+
+func init() {
+	RegisterBackend("sqlite", func(dsn string) (KVStore, error) {
+		return NewSQLiteKVStore(dsn)
+	})
+}
+
+// SQLiteKVStore implements KVStore on top of a local SQLite database,
+// mirroring RiakKVStore's metadata and chunk buckets as the metadata and
+// chunks tables, with dentries, dedup_config and dentry_mode_config tables
+// beside them. Riak's vclock CAS
+// is replaced by a plain integer version column: UpdateMetadata succeeds
+// only if the row's version still matches the version the caller last read.
+type SQLiteKVStore struct {
+	dsn string
+	db  *sql.DB
+
+	dedupMu      sync.Mutex
+	dedupLoaded  bool
+	dedupEnabled bool
+
+	dentryModeMu      sync.Mutex
+	dentryModeLoaded  bool
+	dentryModeEnabled bool
+}
+
+// NewSQLiteKVStore opens (and if necessary creates) a SQLite-backed store
+// at dsn, e.g. "file:/var/lib/bang.db" or "file::memory:?cache=shared".
+func NewSQLiteKVStore(dsn string) (*SQLiteKVStore, error) {
+	kv := &SQLiteKVStore{dsn: dsn}
+	if err := kv.Connect(); err != nil {
+		return kv, err
+	}
+	return kv, nil
+}
+
+// Connect opens the database file and creates the schema if it's missing.
+func (kv *SQLiteKVStore) Connect() error {
+	db, err := sql.Open("sqlite", kv.dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open sqlite db: %w", err)
+	}
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS metadata (
+			inum    INTEGER PRIMARY KEY,
+			version INTEGER NOT NULL,
+			data    BLOB NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS chunks (
+			key      INTEGER PRIMARY KEY,
+			data     BLOB NOT NULL,
+			refcount INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS dedup_config (
+			id      INTEGER PRIMARY KEY CHECK (id = 0),
+			enabled INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS dentry_mode_config (
+			id      INTEGER PRIMARY KEY CHECK (id = 0),
+			enabled INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS dentries (
+			parent INTEGER NOT NULL,
+			name   TEXT NOT NULL,
+			data   BLOB NOT NULL,
+			PRIMARY KEY (parent, name)
+		);
+		CREATE INDEX IF NOT EXISTS dentries_parent_idx ON dentries (parent);
+	`); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to create schema: %w", err)
+	}
+	kv.db = db
+	return nil
+}
+
+func (kv *SQLiteKVStore) Close() error {
+	if kv.db != nil {
+		return kv.db.Close()
+	}
+	return nil
+}
+
+// InitBackend creates the root inode (inode 0), same contract as
+// RiakKVStore.InitBackend/FileKVStore.InitBackend.
+func (kv *SQLiteKVStore) InitBackend() error {
+	existing, _, err := kv.Metadata(0)
+	if err == nil && existing != nil {
+		return fmt.Errorf("filesystem already exists (inode 0 found in %s). Use WipeBackend() first to reinitialize", kv.dsn)
+	}
+
+	now := time.Now().UnixNano()
+	rootDir := &bangpb.InodeMeta{
+		Name: "", ParentInode: 0,
+		Mode:         0755 | syscall.S_IFDIR,
+		CtimeNs:      now,
+		MtimeNs:      now,
+		AtimeNs:      now,
+		ChildEntries: []*bangpb.ChildEntry{},
+		Nlink:        2,
+	}
+	_, err = kv.PutMetadata(0, rootDir)
+	return err
+}
+
+func (kv *SQLiteKVStore) PutMetadata(key uint64, newMeta *bangpb.InodeMeta) ([]byte, error) {
+	data, err := proto.Marshal(newMeta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	return kv.PutMetadataBytes(key, data)
+}
+
+// PutMetadataBytes fails if key already exists, matching the Riak
+// IfNoneMatch/File os.Stat behavior.
+func (kv *SQLiteKVStore) PutMetadataBytes(key uint64, data []byte) ([]byte, error) {
+	if _, err := kv.db.Exec(`INSERT INTO metadata (inum, version, data) VALUES (?, 1, ?)`, key, data); err != nil {
+		return nil, fmt.Errorf("key already exists: %d: %w", key, err)
+	}
+	return versionToVClock(1), nil
+}
+
+func (kv *SQLiteKVStore) Metadata(key uint64) (*bangpb.InodeMeta, []byte, error) {
+	data, vclock, err := kv.MetadataBytes(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &bangpb.InodeMeta{}
+	if err := proto.Unmarshal(data, meta); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	return meta, vclock, nil
+}
+
+func (kv *SQLiteKVStore) MetadataBytes(key uint64) ([]byte, []byte, error) {
+	var data []byte
+	var version uint64
+	row := kv.db.QueryRow(`SELECT data, version FROM metadata WHERE inum = ?`, key)
+	if err := row.Scan(&data, &version); err != nil {
+		return nil, nil, fmt.Errorf("key not found: %d", key)
+	}
+	return data, versionToVClock(version), nil
+}
+
+func (kv *SQLiteKVStore) UpdateMetadata(key uint64, newMeta *bangpb.InodeMeta, vclockIn []byte) ([]byte, error) {
+	data, err := proto.Marshal(newMeta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	return kv.UpdateMetadataBytes(key, data, vclockIn)
+}
+
+// UpdateMetadataBytes only applies the write if the row's version still
+// matches vclockIn, the SQL equivalent of Riak's IfNotModified/vclock CAS.
+func (kv *SQLiteKVStore) UpdateMetadataBytes(key uint64, data []byte, vclockIn []byte) ([]byte, error) {
+	version := vclockToVersion(vclockIn)
+	res, err := kv.db.Exec(`UPDATE metadata SET data = ?, version = version + 1 WHERE inum = ? AND version = ?`, data, key, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update metadata: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check update result: %w", err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%w: version mismatch on key %d (or key not found)", ErrVClockConflict, key)
+	}
+	return versionToVClock(version + 1), nil
+}
+
+func (kv *SQLiteKVStore) DeleteMetadata(key uint64, vclockIn []byte) error {
+	var res sql.Result
+	var err error
+	if vclockIn != nil {
+		res, err = kv.db.Exec(`DELETE FROM metadata WHERE inum = ? AND version = ?`, key, vclockToVersion(vclockIn))
+	} else {
+		res, err = kv.db.Exec(`DELETE FROM metadata WHERE inum = ?`, key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete metadata: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 && vclockIn != nil {
+		return fmt.Errorf("version mismatch deleting key %d (concurrent modification)", key)
+	}
+	return nil
+}
+
+// PutChunk stores a chunk by its content-addressed key, matching the
+// Riak/File backends' dedup-aware semantics (see KVStore.PutChunk).
+func (kv *SQLiteKVStore) PutChunk(key uint64, data []byte) error {
+	dedup, err := kv.DedupEnabled()
+	if err != nil {
+		return fmt.Errorf("failed to load dedup setting: %w", err)
+	}
+	if dedup {
+		res, err := kv.db.Exec(`UPDATE chunks SET refcount = refcount + 1 WHERE key = ?`, key)
+		if err != nil {
+			return fmt.Errorf("failed to bump refcount: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return nil
+		}
+	}
+	if _, err := kv.db.Exec(`INSERT INTO chunks (key, data, refcount) VALUES (?, ?, 1)
+		ON CONFLICT(key) DO UPDATE SET data = excluded.data, refcount = chunks.refcount + 1`, key, data); err != nil {
+		return fmt.Errorf("failed to write chunk: %w", err)
+	}
+	return nil
+}
+
+func (kv *SQLiteKVStore) Chunk(key uint64) ([]byte, error) {
+	var data []byte
+	row := kv.db.QueryRow(`SELECT data FROM chunks WHERE key = ?`, key)
+	if err := row.Scan(&data); err != nil {
+		return nil, fmt.Errorf("chunk not found: %016x", key)
+	}
+	return data, nil
+}
+
+// DeleteChunk releases one reference to the chunk at key, physically
+// removing the row only once the refcount reaches zero.
+func (kv *SQLiteKVStore) DeleteChunk(key uint64) error {
+	if _, err := kv.db.Exec(`UPDATE chunks SET refcount = refcount - 1 WHERE key = ?`, key); err != nil {
+		return fmt.Errorf("failed to decrement refcount: %w", err)
+	}
+	count, err := kv.ChunkRefCount(key)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err := kv.db.Exec(`DELETE FROM chunks WHERE key = ?`, key); err != nil {
+		return fmt.Errorf("failed to delete chunk: %w", err)
+	}
+	return nil
+}
+
+// ChunkRefCount reports the current reference count for key, or 0 if it
+// has never been written (or was already GC'd down to zero).
+func (kv *SQLiteKVStore) ChunkRefCount(key uint64) (uint64, error) {
+	var refcount int64
+	row := kv.db.QueryRow(`SELECT refcount FROM chunks WHERE key = ?`, key)
+	if err := row.Scan(&refcount); err != nil {
+		return 0, nil
+	}
+	if refcount < 0 {
+		return 0, nil
+	}
+	return uint64(refcount), nil
+}
+
+func (kv *SQLiteKVStore) SetDedupEnabled(enabled bool) error {
+	value := 0
+	if enabled {
+		value = 1
+	}
+	if _, err := kv.db.Exec(`INSERT INTO dedup_config (id, enabled) VALUES (0, ?)
+		ON CONFLICT(id) DO UPDATE SET enabled = excluded.enabled`, value); err != nil {
+		return fmt.Errorf("failed to write dedup setting: %w", err)
+	}
+	kv.dedupMu.Lock()
+	kv.dedupLoaded = true
+	kv.dedupEnabled = enabled
+	kv.dedupMu.Unlock()
+	return nil
+}
+
+func (kv *SQLiteKVStore) DedupEnabled() (bool, error) {
+	kv.dedupMu.Lock()
+	if kv.dedupLoaded {
+		defer kv.dedupMu.Unlock()
+		return kv.dedupEnabled, nil
+	}
+	kv.dedupMu.Unlock()
+
+	enabled := true
+	var value int
+	row := kv.db.QueryRow(`SELECT enabled FROM dedup_config WHERE id = 0`)
+	if err := row.Scan(&value); err == nil {
+		enabled = value != 0
+	}
+
+	kv.dedupMu.Lock()
+	kv.dedupLoaded = true
+	kv.dedupEnabled = enabled
+	kv.dedupMu.Unlock()
+	return enabled, nil
+}
+
+// SetDentryMode persists whether a directory's children are stored as
+// individual rows in the dentries table instead of being embedded in the
+// parent's ChildEntries.
+func (kv *SQLiteKVStore) SetDentryMode(enabled bool) error {
+	value := 0
+	if enabled {
+		value = 1
+	}
+	if _, err := kv.db.Exec(`INSERT INTO dentry_mode_config (id, enabled) VALUES (0, ?)
+		ON CONFLICT(id) DO UPDATE SET enabled = excluded.enabled`, value); err != nil {
+		return fmt.Errorf("failed to write dentry mode setting: %w", err)
+	}
+	kv.dentryModeMu.Lock()
+	kv.dentryModeLoaded = true
+	kv.dentryModeEnabled = enabled
+	kv.dentryModeMu.Unlock()
+	return nil
+}
+
+// DentryMode reports the current dentry-mode setting, defaulting to false
+// (embedded ChildEntries) if it was never explicitly set.
+func (kv *SQLiteKVStore) DentryMode() (bool, error) {
+	kv.dentryModeMu.Lock()
+	if kv.dentryModeLoaded {
+		defer kv.dentryModeMu.Unlock()
+		return kv.dentryModeEnabled, nil
+	}
+	kv.dentryModeMu.Unlock()
+
+	enabled := false
+	var value int
+	row := kv.db.QueryRow(`SELECT enabled FROM dentry_mode_config WHERE id = 0`)
+	if err := row.Scan(&value); err == nil {
+		enabled = value != 0
+	}
+
+	kv.dentryModeMu.Lock()
+	kv.dentryModeLoaded = true
+	kv.dentryModeEnabled = enabled
+	kv.dentryModeMu.Unlock()
+	return enabled, nil
+}
+
+// PutDentry stores (or overwrites) the row for entry.Name under parent.
+func (kv *SQLiteKVStore) PutDentry(parent uint64, entry *bangpb.ChildEntry) error {
+	data, err := proto.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dentry: %w", err)
+	}
+	if _, err := kv.db.Exec(`INSERT INTO dentries (parent, name, data) VALUES (?, ?, ?)
+		ON CONFLICT(parent, name) DO UPDATE SET data = excluded.data`, parent, entry.Name, data); err != nil {
+		return fmt.Errorf("failed to write dentry: %w", err)
+	}
+	return nil
+}
+
+// DeleteDentry removes the row for name under parent. A no-op if it
+// doesn't exist.
+func (kv *SQLiteKVStore) DeleteDentry(parent uint64, name string) error {
+	if _, err := kv.db.Exec(`DELETE FROM dentries WHERE parent = ? AND name = ?`, parent, name); err != nil {
+		return fmt.Errorf("failed to delete dentry: %w", err)
+	}
+	return nil
+}
+
+// ListChildren queries every row under parent, the SQL equivalent of
+// RiakKVStore's parent_inode_int 2i range query.
+func (kv *SQLiteKVStore) ListChildren(parent uint64) ([]*bangpb.ChildEntry, error) {
+	rows, err := kv.db.Query(`SELECT data FROM dentries WHERE parent = ?`, parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dentries: %w", err)
+	}
+	defer rows.Close()
+
+	var children []*bangpb.ChildEntry
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to scan dentry: %w", err)
+		}
+		entry := &bangpb.ChildEntry{}
+		if err := proto.Unmarshal(data, entry); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal dentry: %w", err)
+		}
+		children = append(children, entry)
+	}
+	return children, rows.Err()
+}
+
+// WipeBackend deletes all rows from the metadata and chunk tables.
+func (kv *SQLiteKVStore) WipeBackend(w io.Writer) error {
+	return kv.WipeBackendCtx(context.Background(), w, DefaultWipeOptions())
+}
+
+// ListKeys streams the primary keys of bucket's table to ch, closing ch
+// when done or ctx is cancelled.
+func (kv *SQLiteKVStore) ListKeys(ctx context.Context, bucket string, ch chan<- string) error {
+	defer close(ch)
+
+	var query string
+	switch bucket {
+	case metadataBucket:
+		query = `SELECT inum FROM metadata`
+	case chunkBucket:
+		query = `SELECT key FROM chunks`
+	default:
+		return fmt.Errorf("unknown bucket %q", bucket)
+	}
+
+	rows, err := kv.db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to list keys in %s: %w", bucket, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key uint64
+		if err := rows.Scan(&key); err != nil {
+			return fmt.Errorf("failed to scan key in %s: %w", bucket, err)
+		}
+		select {
+		case ch <- fmt.Sprintf("%d", key):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return rows.Err()
+}
+
+// WipeBackendCtx deletes all rows from the metadata and chunk tables,
+// streaming their keys via ListKeys and honoring ctx cancellation.
+// opts.Workers is accepted for interface parity with RiakKVStore but
+// unused: a local SQLite file has no coverage-query cost to amortize with
+// concurrency, and SQLite serializes writers anyway.
+func (kv *SQLiteKVStore) WipeBackendCtx(ctx context.Context, w io.Writer, opts WipeOptions) error {
+	for _, b := range []struct{ bucket, table, idCol string }{
+		{metadataBucket, "metadata", "inum"},
+		{chunkBucket, "chunks", "key"},
+	} {
+		fmt.Fprintf(w, "  wiping %s [%s]...\n", b.bucket, b.table)
+		keys := make(chan string)
+		listDone := make(chan error, 1)
+		go func(bucket string) { listDone <- kv.ListKeys(ctx, bucket, keys) }(b.bucket)
+
+		n := 0
+		for key := range keys {
+			if _, err := kv.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s = ?`, b.table, b.idCol), key); err != nil {
+				return fmt.Errorf("failed to delete %s from %s: %w", key, b.table, err)
+			}
+			n++
+		}
+		if err := <-listDone; err != nil {
+			return fmt.Errorf("failed to list %s keys: %w", b.bucket, err)
+		}
+		fmt.Fprintf(w, "  deleted %d keys from %s\n", n, b.bucket)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	res, err := kv.db.Exec(`DELETE FROM dentries`)
+	if err != nil {
+		return fmt.Errorf("failed to wipe dentries: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	fmt.Fprintf(w, "  deleted %d keys from %s\n", n, dentryBucket)
+	return nil
+}
+
+// versionToVClock/vclockToVersion adapt the plain integer version column to
+// the []byte vclock shape the rest of KVStore expects.
+func versionToVClock(version uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, version)
+	return buf
+}
+
+func vclockToVersion(vclock []byte) uint64 {
+	if len(vclock) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(vclock)
+}
@@ -0,0 +1,184 @@
+package bangfuse
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"bangfs/bangutil"
+	bangpb "bangfs/proto"
+)
+
+// statsKVStore decorates a KVStore, recording op-count/bytes-in/bytes-out/
+// latency for each call into the global bangutil.Tracer. It intercepts every
+// call through a struct field (the embedded KVStore) so the wrapped backend
+// stays unchanged, the same shape as EncryptedKVStore.
+type statsKVStore struct {
+	KVStore
+}
+
+// WrapWithStats wraps kv so every PutMetadata/Metadata/UpdateMetadata/
+// DeleteMetadata/PutChunk/Chunk/DeleteChunk call is recorded via
+// bangutil.GetTracer().Stats(). Construct backends through this instead of
+// baking instrumentation into each KVStore implementation.
+func WrapWithStats(kv KVStore) KVStore {
+	return &statsKVStore{KVStore: kv}
+}
+
+func (kv *statsKVStore) PutMetadata(key uint64, newMeta *bangpb.InodeMeta) ([]byte, error) {
+	start := time.Now()
+	vclock, err := kv.KVStore.PutMetadata(key, newMeta)
+	bangutil.GetTracer().RecordKVOp("PutMetadata", proto.Size(newMeta), 0, time.Since(start), err)
+	return vclock, err
+}
+
+func (kv *statsKVStore) Metadata(key uint64) (*bangpb.InodeMeta, []byte, error) {
+	start := time.Now()
+	meta, vclock, err := kv.KVStore.Metadata(key)
+	bangutil.GetTracer().RecordKVOp("Metadata", 0, proto.Size(meta), time.Since(start), err)
+	return meta, vclock, err
+}
+
+func (kv *statsKVStore) UpdateMetadata(key uint64, newMeta *bangpb.InodeMeta, vclockIn []byte) ([]byte, error) {
+	start := time.Now()
+	vclock, err := kv.KVStore.UpdateMetadata(key, newMeta, vclockIn)
+	bangutil.GetTracer().RecordKVOp("UpdateMetadata", proto.Size(newMeta), 0, time.Since(start), err)
+	return vclock, err
+}
+
+func (kv *statsKVStore) DeleteMetadata(key uint64, vclockIn []byte) error {
+	start := time.Now()
+	err := kv.KVStore.DeleteMetadata(key, vclockIn)
+	bangutil.GetTracer().RecordKVOp("DeleteMetadata", 0, 0, time.Since(start), err)
+	return err
+}
+
+func (kv *statsKVStore) PutChunk(key uint64, data []byte) error {
+	start := time.Now()
+	err := kv.KVStore.PutChunk(key, data)
+	bangutil.GetTracer().RecordKVOp("PutChunk", len(data), 0, time.Since(start), err)
+	return err
+}
+
+func (kv *statsKVStore) Chunk(key uint64) ([]byte, error) {
+	start := time.Now()
+	data, err := kv.KVStore.Chunk(key)
+	bangutil.GetTracer().RecordKVOp("Chunk", 0, len(data), time.Since(start), err)
+	return data, err
+}
+
+func (kv *statsKVStore) DeleteChunk(key uint64) error {
+	start := time.Now()
+	err := kv.KVStore.DeleteChunk(key)
+	bangutil.GetTracer().RecordKVOp("DeleteChunk", 0, 0, time.Since(start), err)
+	return err
+}
+
+func (kv *statsKVStore) PutChunkClass(class string, key uint64, data []byte) error {
+	start := time.Now()
+	var err error
+	if cc, ok := kv.KVStore.(classAwareKVStore); ok {
+		err = cc.PutChunkClass(class, key, data)
+	} else {
+		err = kv.KVStore.PutChunk(key, data)
+	}
+	bangutil.GetTracer().RecordKVOp("PutChunkClass", len(data), 0, time.Since(start), err)
+	return err
+}
+
+func (kv *statsKVStore) ChunkClass(class string, key uint64) ([]byte, error) {
+	start := time.Now()
+	var data []byte
+	var err error
+	if cc, ok := kv.KVStore.(classAwareKVStore); ok {
+		data, err = cc.ChunkClass(class, key)
+	} else {
+		data, err = kv.KVStore.Chunk(key)
+	}
+	bangutil.GetTracer().RecordKVOp("ChunkClass", 0, len(data), time.Since(start), err)
+	return data, err
+}
+
+// MetricsHandler renders the accumulated KVStore op stats in Prometheus text
+// exposition format. Wire it up behind an opt-in flag, e.g.:
+//
+//	http.Handle("/metrics", bangfuse.MetricsHandler())
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, bangutil.GetTracer().Stats())
+		writeOpenCacheMetrics(w, gOpenCache)
+	})
+}
+
+func writeOpenCacheMetrics(w io.Writer, c *OpenCache) {
+	hits, misses := c.Stats()
+	fmt.Fprintln(w, "# HELP bangfs_open_cache_hits_total Open-file metadata cache hits.")
+	fmt.Fprintln(w, "# TYPE bangfs_open_cache_hits_total counter")
+	fmt.Fprintf(w, "bangfs_open_cache_hits_total %d\n", hits)
+	fmt.Fprintln(w, "# HELP bangfs_open_cache_misses_total Open-file metadata cache misses.")
+	fmt.Fprintln(w, "# TYPE bangfs_open_cache_misses_total counter")
+	fmt.Fprintf(w, "bangfs_open_cache_misses_total %d\n", misses)
+}
+
+func writeMetrics(w io.Writer, stats map[string]bangutil.OpStats) {
+	ops := make([]string, 0, len(stats))
+	for op := range stats {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	fmt.Fprintln(w, "# HELP bangfs_kv_op_total Total KVStore method calls.")
+	fmt.Fprintln(w, "# TYPE bangfs_kv_op_total counter")
+	for _, op := range ops {
+		fmt.Fprintf(w, "bangfs_kv_op_total{op=%q} %d\n", op, stats[op].Count)
+	}
+
+	fmt.Fprintln(w, "# HELP bangfs_kv_op_errors_total Failed KVStore method calls.")
+	fmt.Fprintln(w, "# TYPE bangfs_kv_op_errors_total counter")
+	for _, op := range ops {
+		fmt.Fprintf(w, "bangfs_kv_op_errors_total{op=%q} %d\n", op, stats[op].Errors)
+	}
+
+	fmt.Fprintln(w, "# HELP bangfs_kv_bytes_in_total Bytes written to the backend per method.")
+	fmt.Fprintln(w, "# TYPE bangfs_kv_bytes_in_total counter")
+	for _, op := range ops {
+		fmt.Fprintf(w, "bangfs_kv_bytes_in_total{op=%q} %d\n", op, stats[op].BytesIn)
+	}
+
+	fmt.Fprintln(w, "# HELP bangfs_kv_bytes_out_total Bytes read from the backend per method.")
+	fmt.Fprintln(w, "# TYPE bangfs_kv_bytes_out_total counter")
+	for _, op := range ops {
+		fmt.Fprintf(w, "bangfs_kv_bytes_out_total{op=%q} %d\n", op, stats[op].BytesOut)
+	}
+
+	fmt.Fprintln(w, "# HELP bangfs_kv_op_duration_seconds KVStore method latency.")
+	fmt.Fprintln(w, "# TYPE bangfs_kv_op_duration_seconds histogram")
+	for _, op := range ops {
+		buckets := stats[op].Buckets
+		var cumulative uint64
+		for i, ub := range bangutil.LatencyBucketsSeconds {
+			if i < len(buckets) {
+				cumulative += buckets[i]
+			}
+			fmt.Fprintf(w, "bangfs_kv_op_duration_seconds_bucket{op=%q,le=%q} %d\n", op, formatBucketBound(ub), cumulative)
+		}
+		if len(buckets) > len(bangutil.LatencyBucketsSeconds) {
+			cumulative += buckets[len(bangutil.LatencyBucketsSeconds)]
+		}
+		fmt.Fprintf(w, "bangfs_kv_op_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, cumulative)
+		fmt.Fprintf(w, "bangfs_kv_op_duration_seconds_sum{op=%q} %f\n", op, float64(stats[op].TotalNs)/1e9)
+		fmt.Fprintf(w, "bangfs_kv_op_duration_seconds_count{op=%q} %d\n", op, stats[op].Count)
+	}
+}
+
+// formatBucketBound renders a histogram bucket's upper bound the way
+// Prometheus text exposition expects for the "le" label.
+func formatBucketBound(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'g', -1, 64)
+}
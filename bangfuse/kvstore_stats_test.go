@@ -0,0 +1,34 @@
+package bangfuse
+
+import (
+	"testing"
+
+	"bangfs/bangutil"
+)
+
+// statsKVStore should be a transparent decorator: it must pass the same
+// shared test suite as any other KVStore.
+func TestStats_SanityCheck(t *testing.T) {
+	testAllTests(t, WrapWithStats(testFileKV(t)))
+}
+
+func TestStats_RecordsCounters(t *testing.T) {
+	kv := WrapWithStats(testFileKV(t))
+
+	var inum uint64 = 9999901
+	meta := makeTestMeta("stats.txt")
+	if _, err := kv.PutMetadata(inum, meta); err != nil {
+		t.Fatalf("PutMetadata: %v", err)
+	}
+	if _, _, err := kv.Metadata(inum); err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+
+	stats := bangutil.GetTracer().Stats()
+	if stats["PutMetadata"].Count == 0 {
+		t.Fatalf("expected PutMetadata to be recorded, got %+v", stats["PutMetadata"])
+	}
+	if stats["Metadata"].Count == 0 {
+		t.Fatalf("expected Metadata to be recorded, got %+v", stats["Metadata"])
+	}
+}
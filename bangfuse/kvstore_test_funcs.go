@@ -177,6 +177,152 @@ func testDeleteChunk(t *testing.T, kv KVStore) {
 	}
 }
 
+func testChunkDedupRefcounting(t *testing.T, kv KVStore) {
+	t.Helper()
+
+	var key uint64 = 0xDEADBEEF999B
+	data := []byte("shared chunk content")
+
+	kv.DeleteChunk(key)
+	for {
+		count, err := kv.ChunkRefCount(key)
+		if err != nil {
+			t.Fatalf("ChunkRefCount: %v", err)
+		}
+		if count == 0 {
+			break
+		}
+		kv.DeleteChunk(key)
+	}
+	t.Cleanup(func() { kv.DeleteChunk(key) })
+
+	// Two "owners" PutChunk the same content at the same key, as they would
+	// after both computing bangutil.ChunkKey(bangutil.HashChunk(data)).
+	if err := kv.PutChunk(key, data); err != nil {
+		t.Fatalf("PutChunk (1st owner): %v", err)
+	}
+	if err := kv.PutChunk(key, data); err != nil {
+		t.Fatalf("PutChunk (2nd owner): %v", err)
+	}
+	if count, err := kv.ChunkRefCount(key); err != nil || count != 2 {
+		t.Fatalf("ChunkRefCount after 2 puts = (%d, %v), want (2, nil)", count, err)
+	}
+
+	// Releasing one owner's reference must not delete the shared bytes.
+	if err := kv.DeleteChunk(key); err != nil {
+		t.Fatalf("DeleteChunk (1st owner): %v", err)
+	}
+	got, err := kv.Chunk(key)
+	if err != nil {
+		t.Fatalf("Chunk still referenced by 2nd owner: %v", err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("Chunk data = %q, want %q", got, data)
+	}
+
+	// Releasing the last reference does delete it.
+	if err := kv.DeleteChunk(key); err != nil {
+		t.Fatalf("DeleteChunk (2nd owner): %v", err)
+	}
+	if _, err := kv.Chunk(key); err == nil {
+		t.Fatal("expected error after last reference released, got nil")
+	}
+}
+
+func testDedupToggle(t *testing.T, kv KVStore) {
+	t.Helper()
+
+	enabled, err := kv.DedupEnabled()
+	if err != nil {
+		t.Fatalf("DedupEnabled: %v", err)
+	}
+	t.Cleanup(func() { kv.SetDedupEnabled(enabled) })
+
+	var key uint64 = 0xDEADBEEF999C
+	data := []byte("toggle me")
+	kv.DeleteChunk(key)
+	t.Cleanup(func() { kv.DeleteChunk(key) })
+
+	if err := kv.SetDedupEnabled(false); err != nil {
+		t.Fatalf("SetDedupEnabled(false): %v", err)
+	}
+	if got, err := kv.DedupEnabled(); err != nil || got {
+		t.Fatalf("DedupEnabled after SetDedupEnabled(false) = (%v, %v), want (false, nil)", got, err)
+	}
+
+	// With dedup off, a second PutChunk at the same key rewrites the bytes
+	// and still adds a reference, so each put has its own DeleteChunk.
+	if err := kv.PutChunk(key, data); err != nil {
+		t.Fatalf("PutChunk (1st): %v", err)
+	}
+	if err := kv.PutChunk(key, data); err != nil {
+		t.Fatalf("PutChunk (2nd): %v", err)
+	}
+	if count, err := kv.ChunkRefCount(key); err != nil || count != 2 {
+		t.Fatalf("ChunkRefCount with dedup off = (%d, %v), want (2, nil)", count, err)
+	}
+
+	if err := kv.SetDedupEnabled(true); err != nil {
+		t.Fatalf("SetDedupEnabled(true): %v", err)
+	}
+	if got, err := kv.DedupEnabled(); err != nil || !got {
+		t.Fatalf("DedupEnabled after SetDedupEnabled(true) = (%v, %v), want (true, nil)", got, err)
+	}
+}
+
+func testDentryMode(t *testing.T, kv KVStore) {
+	t.Helper()
+
+	enabled, err := kv.DentryMode()
+	if err != nil {
+		t.Fatalf("DentryMode: %v", err)
+	}
+	t.Cleanup(func() { kv.SetDentryMode(enabled) })
+
+	if err := kv.SetDentryMode(true); err != nil {
+		t.Fatalf("SetDentryMode(true): %v", err)
+	}
+	if got, err := kv.DentryMode(); err != nil || !got {
+		t.Fatalf("DentryMode after SetDentryMode(true) = (%v, %v), want (true, nil)", got, err)
+	}
+
+	var parent uint64 = 0xD00D
+	t.Cleanup(func() {
+		kv.DeleteDentry(parent, "alpha")
+		kv.DeleteDentry(parent, "beta")
+	})
+
+	if err := kv.PutDentry(parent, &bangpb.ChildEntry{Name: "alpha", Inode: 111}); err != nil {
+		t.Fatalf("PutDentry(alpha): %v", err)
+	}
+	if err := kv.PutDentry(parent, &bangpb.ChildEntry{Name: "beta", Inode: 222}); err != nil {
+		t.Fatalf("PutDentry(beta): %v", err)
+	}
+
+	children, err := kv.ListChildren(parent)
+	if err != nil {
+		t.Fatalf("ListChildren: %v", err)
+	}
+	byName := map[string]uint64{}
+	for _, c := range children {
+		byName[c.Name] = c.Inode
+	}
+	if byName["alpha"] != 111 || byName["beta"] != 222 {
+		t.Fatalf("ListChildren = %v, want alpha=111 beta=222", byName)
+	}
+
+	if err := kv.DeleteDentry(parent, "alpha"); err != nil {
+		t.Fatalf("DeleteDentry(alpha): %v", err)
+	}
+	children, err = kv.ListChildren(parent)
+	if err != nil {
+		t.Fatalf("ListChildren after delete: %v", err)
+	}
+	if len(children) != 1 || children[0].Name != "beta" {
+		t.Fatalf("ListChildren after DeleteDentry(alpha) = %v, want only beta", children)
+	}
+}
+
 func testMetadataNotFound(t *testing.T, kv KVStore) {
 	t.Helper()
 
@@ -245,6 +391,9 @@ func testAllTests(t *testing.T, kv KVStore) {
 	testDeleteMetadata(t, kv)
 	testPutAndGetChunk(t, kv)
 	testDeleteChunk(t, kv)
+	testChunkDedupRefcounting(t, kv)
+	testDedupToggle(t, kv)
+	testDentryMode(t, kv)
 	testMetadataNotFound(t, kv)
 	testChunkNotFound(t, kv)
 	testGetMetadataAfterDeleteFails(t, kv)
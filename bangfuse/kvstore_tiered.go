@@ -0,0 +1,129 @@
+package bangfuse
+
+import (
+	"fmt"
+
+	bangpb "bangfs/proto"
+)
+
+// defaultStorageClass is used for inodes with no explicit StorageClass (e.g.
+// written before tiering was configured, or never given the xattr).
+const defaultStorageClass = "hot"
+
+// TieredKVStore composes multiple KVStore backends and routes chunk
+// Put/Get by the storage-class tag on the owning inode's InodeMeta
+// (InodeMeta.StorageClass, set via the user.bangfs.class xattr — see
+// BangFileNode.Setxattr). Metadata always goes to a single primary tier so
+// directory/lookup traffic doesn't have to consult the routing table.
+type TieredKVStore struct {
+	KVStore                    // primary tier: metadata + fallback chunk tier
+	tiers   map[string]KVStore // storage class -> chunk tier
+	order   []string           // probe order for Chunk() fallback, primary first
+}
+
+// NewTieredKVStore builds a TieredKVStore whose metadata and default chunk
+// tier is primary. tiers maps a storage-class name (as set via
+// user.bangfs.class) to the backend that should hold its chunks; it need not
+// include defaultStorageClass, which always resolves to primary.
+func NewTieredKVStore(primary KVStore, tiers map[string]KVStore) *TieredKVStore {
+	order := make([]string, 0, len(tiers)+1)
+	order = append(order, defaultStorageClass)
+	for class := range tiers {
+		if class != defaultStorageClass {
+			order = append(order, class)
+		}
+	}
+	return &TieredKVStore{KVStore: primary, tiers: tiers, order: order}
+}
+
+// tierFor resolves a storage-class name to its backend, falling back to the
+// primary tier for the default class or any class with no configured tier.
+func (kv *TieredKVStore) tierFor(class string) KVStore {
+	if class == "" || class == defaultStorageClass {
+		return kv.KVStore
+	}
+	if tier, ok := kv.tiers[class]; ok {
+		return tier
+	}
+	return kv.KVStore
+}
+
+// PutChunkClass stores data in the tier for class, the storage-class-aware
+// counterpart to KVStore.PutChunk used once a class has been resolved (e.g.
+// from InodeMeta.StorageClass in BangFH.writeAt/appendChunk).
+func (kv *TieredKVStore) PutChunkClass(class string, key uint64, data []byte) error {
+	return kv.tierFor(class).PutChunk(key, data)
+}
+
+// ChunkClass fetches a chunk, trying the class-specified tier first and
+// then probing the others in turn, so chunks left behind by a since-changed
+// or since-removed storage class stay readable.
+func (kv *TieredKVStore) ChunkClass(class string, key uint64) ([]byte, error) {
+	tried := make(map[KVStore]bool)
+	primary := kv.tierFor(class)
+	if data, err := primary.Chunk(key); err == nil {
+		return data, nil
+	}
+	tried[primary] = true
+
+	var lastErr error = fmt.Errorf("chunk not found: %016x", key)
+	for _, c := range kv.order {
+		tier := kv.tierFor(c)
+		if tried[tier] {
+			continue
+		}
+		tried[tier] = true
+		if data, err := tier.Chunk(key); err == nil {
+			return data, nil
+		} else {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// PutChunk implements the base KVStore interface by routing to the default
+// tier; callers that know the inode's storage class should use
+// PutChunkClass instead.
+func (kv *TieredKVStore) PutChunk(key uint64, data []byte) error {
+	return kv.KVStore.PutChunk(key, data)
+}
+
+// Chunk implements the base KVStore interface by probing every configured
+// tier in order; callers that know the inode's storage class should use
+// ChunkClass instead to avoid the extra probes.
+func (kv *TieredKVStore) Chunk(key uint64) ([]byte, error) {
+	return kv.ChunkClass(defaultStorageClass, key)
+}
+
+// StorageClassOf returns meta's storage class, or defaultStorageClass if
+// unset.
+func StorageClassOf(meta *bangpb.InodeMeta) string {
+	if meta.StorageClass == "" {
+		return defaultStorageClass
+	}
+	return meta.StorageClass
+}
+
+// classAwareKVStore is implemented by backends that can place/fetch a chunk
+// by storage class instead of always using the default tier (currently only
+// TieredKVStore). Decorators that wrap one forward PutChunkClass/ChunkClass
+// through to it — see CachingKVStore, EncryptedKVStore, and statsKVStore —
+// so gKVStore can be any of those stacked on top of a TieredKVStore and
+// class-aware placement still reaches it.
+type classAwareKVStore interface {
+	PutChunkClass(class string, key uint64, data []byte) error
+	ChunkClass(class string, key uint64) ([]byte, error)
+}
+
+// putChunkForClass writes data for key, routing through class's storage
+// tier if gKVStore is class-aware, and falling back to the plain
+// default-tier PutChunk otherwise. This is what makes the user.bangfs.class
+// xattr (see BangFileNode.Setxattr) actually affect where a chunk's bytes
+// land, rather than only being recorded on the inode.
+func putChunkForClass(class string, key uint64, data []byte) error {
+	if cc, ok := gKVStore.(classAwareKVStore); ok {
+		return cc.PutChunkClass(class, key, data)
+	}
+	return gKVStore.PutChunk(key, data)
+}
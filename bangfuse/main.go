@@ -7,6 +7,7 @@ package bangfuse
 import (
 	"fmt"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -17,14 +18,25 @@ import (
 // TODO: move into the root inode and access with .Root()
 var gKVStore KVStore
 var gInumgen *IdGenerator
-var gChunkidgen *IdGenerator
+
+// gOpenCache caches InodeMeta/vclock for open inodes; see OpenCache. It's
+// disabled (TTL 0) by default — set via BangServer.SetOpenCacheTTL before
+// Mount, which mirrors the --open-cache flag in mount-fuse-bangfs.
+var gOpenCache = NewOpenCache(0)
 
 const gChunksize = 1024 * 1024 // 1MB
 
 // BangServer wraps a FUSE server and its backend KV connection.
 type BangServer struct {
 	*fuse.Server
-	kv KVStore
+	kv           KVStore
+	openCacheTTL time.Duration
+}
+
+// SetOpenCacheTTL configures the open-file metadata cache TTL; must be
+// called before Mount. A zero TTL (the default) disables the cache.
+func (bs *BangServer) SetOpenCacheTTL(ttl time.Duration) {
+	bs.openCacheTTL = ttl
 }
 
 // NewBangServer connects to a Riak backend and verifies the filesystem exists.
@@ -50,8 +62,9 @@ func NewBangServerWithKV(kvStore KVStore) (*BangServer, error) {
 // Mount mounts a BangFS filesystem at the given mountpoint.
 func (bs *BangServer) Mount(mountpoint string) error {
 	gKVStore = bs.kv
-	gInumgen = NewIdGenerator()
-	gChunkidgen = NewIdGenerator()
+	gInumgen = NewIdGenerator("inode")
+	gOpenCache = NewOpenCache(bs.openCacheTTL)
+	gChunkGC.Start()
 
 	root := &BangDirNode{}
 	server, err := fs.Mount(mountpoint, root, &fs.Options{
@@ -64,8 +77,10 @@ func (bs *BangServer) Mount(mountpoint string) error {
 			//In Linux 4.20 and later, the value
 			//   can go up to 1 MiB and go-fuse calculates the MaxPages value acc.
 			//   to MaxWrite, rounding up.
-			MaxWrite:      gChunksize,
-			DisableXAttrs: true,
+			MaxWrite: gChunksize,
+			// xattrs are used to expose/set per-inode storage class
+			// (user.bangfs.class); see BangFileNode.Setxattr.
+			DisableXAttrs: false,
 			//Logger:        nil,
 
 			// If set, ask kernel not to do automatic data cache invalidation.
@@ -84,7 +99,47 @@ func (bs *BangServer) Mount(mountpoint string) error {
 	return nil
 }
 
-// Close shuts down the backend connection.
+// Close shuts down the background chunk GC and the backend connection.
 func (bs *BangServer) Close() error {
+	gChunkGC.Stop()
 	return bs.kv.Close()
 }
+
+// MountOverlay mounts a writable overlay of upper over lower: reads and
+// directory listings merge both, while every write lands in upper. gKVStore
+// is pinned to upper for the mount's lifetime (BangOverlayFileNode relies on
+// this once a file has been copied up), so Close on the returned BangServer
+// only closes upper — lower is owned by the caller and outlives the mount.
+func MountOverlay(mountpoint string, lower, upper KVStore) (*BangServer, error) {
+	if _, _, err := lower.Metadata(0); err != nil {
+		return nil, fmt.Errorf("lower filesystem not initialized: %w", err)
+	}
+	if _, _, err := upper.Metadata(0); err != nil {
+		return nil, fmt.Errorf("upper filesystem not initialized (run mkbangfs against it first): %w", err)
+	}
+
+	gKVStore = upper
+	gInumgen = NewIdGenerator("inode")
+	gOpenCache = NewOpenCache(0)
+	gChunkGC.Start()
+
+	root := NewBangOverlayRoot(lower, upper)
+	server, err := fs.Mount(mountpoint, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:         "bangfs",
+			Name:           "bangfs-overlay",
+			EnableLocks:    false,
+			SingleThreaded: false,
+			MaxWrite:       gChunksize,
+			DisableXAttrs:  false,
+		},
+		RootStableAttr: &fs.StableAttr{
+			Mode: syscall.S_IFDIR,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BangServer{Server: server, kv: upper}, nil
+}
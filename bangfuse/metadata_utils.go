@@ -7,6 +7,7 @@ import (
 	"syscall"
 	"time"
 
+	"bangfs/bangutil"
 	pb "bangfs/proto"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -40,6 +41,42 @@ func IsFile(meta *pb.InodeMeta) bool {
 	return meta.Mode&syscall.S_IFMT == syscall.S_IFREG
 }
 
+// IsSymlink returns true if the metadata represents a symbolic link.
+func IsSymlink(meta *pb.InodeMeta) bool {
+	return meta.Mode&syscall.S_IFMT == syscall.S_IFLNK
+}
+
+// finalizeIfOrphaned deletes inum's chunks and metadata once both its link
+// count and open-handle count have reached zero. It's a no-op otherwise, so
+// it's safe to call both from Unlink (right after Nlink drops) and from
+// BangFH.Release (right after the last handle on an already-unlinked inode
+// closes) — whichever of those happens last is the one that actually
+// deletes it.
+func finalizeIfOrphaned(inum uint64) error {
+	if gOpenHandles.Open(inum) {
+		return nil
+	}
+	meta, vclock, err := gKVStore.Metadata(inum)
+	if err != nil {
+		return fmt.Errorf("getting metadata: %w", err)
+	}
+	if meta.Nlink > 0 {
+		return nil
+	}
+
+	op := bangutil.GetTracer().Op("finalizeIfOrphaned", inum, meta.Name)
+	for _, c := range meta.Chunks {
+		if err := gKVStore.DeleteChunk(c.Hash); err != nil {
+			op.Error(fmt.Errorf("deleting chunk %v, queuing for retry: %w", c.Hash, err))
+			gChunkGC.Enqueue(c.Hash)
+		}
+	}
+	if err := gKVStore.DeleteMetadata(inum, vclock); err != nil {
+		return fmt.Errorf("deleting metadata: %w", err)
+	}
+	return nil
+}
+
 // DumpMeta returns a human-readable string of all inode metadata fields.
 func DumpMeta(inum uint64, meta *pb.InodeMeta) string {
 	var b strings.Builder
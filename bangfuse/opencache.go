@@ -0,0 +1,141 @@
+package bangfuse
+
+import (
+	"sync"
+	"time"
+
+	bangpb "bangfs/proto"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// openCacheEntry holds the cached metadata for one open inode plus the
+// bookkeeping needed to know when it's safe to drop or must be refreshed.
+type openCacheEntry struct {
+	meta     *bangpb.InodeMeta
+	vclock   []byte
+	expireAt time.Time
+	refcount int
+}
+
+// OpenCache caches InodeMeta (and its vclock) for currently-open inodes,
+// keyed by inum, so that Getattr and Write don't have to round-trip to
+// the backend on every call (Setattr still reads the backend, then
+// refreshes the cached copy). Entries with a positive refcount never expire
+// (concurrent opens keep a just-written file's size stable for stat()
+// loops); once the refcount drops to zero the entry is still served until
+// its TTL elapses, then the next lookup falls through to the backend. A TTL
+// of zero disables caching entirely.
+type OpenCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[uint64]*openCacheEntry
+	hits    uint64
+	misses  uint64
+}
+
+// NewOpenCache creates an OpenCache with the given TTL. A zero TTL disables
+// caching: Open/Get/Update become no-ops and Get always reports a miss.
+func NewOpenCache(ttl time.Duration) *OpenCache {
+	return &OpenCache{
+		ttl:     ttl,
+		entries: make(map[uint64]*openCacheEntry),
+	}
+}
+
+// Enabled reports whether caching is turned on (TTL > 0).
+func (c *OpenCache) Enabled() bool {
+	return c.ttl > 0
+}
+
+// Open seeds (or refcounts an existing entry for) inum with meta/vclock,
+// called when a file is opened.
+func (c *OpenCache) Open(inum uint64, meta *bangpb.InodeMeta, vclock []byte) {
+	if !c.Enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[inum]; ok {
+		e.refcount++
+		return
+	}
+	c.entries[inum] = &openCacheEntry{
+		meta:     proto.Clone(meta).(*bangpb.InodeMeta),
+		vclock:   vclock,
+		expireAt: time.Now().Add(c.ttl),
+		refcount: 1,
+	}
+}
+
+// Release decrements the refcount for inum after a file handle closes. The
+// entry itself is kept around (subject to its TTL) in case the file is
+// reopened shortly after.
+func (c *OpenCache) Release(inum uint64) {
+	if !c.Enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[inum]; ok && e.refcount > 0 {
+		e.refcount--
+	}
+}
+
+// Get returns the cached metadata for inum if it's open (refcount > 0) or
+// hasn't yet expired. The returned InodeMeta is a fresh copy the caller is
+// free to mutate; it never aliases the cached entry or another caller's copy.
+func (c *OpenCache) Get(inum uint64) (*bangpb.InodeMeta, []byte, bool) {
+	if !c.Enabled() {
+		return nil, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[inum]
+	if !ok {
+		c.misses++
+		return nil, nil, false
+	}
+	if e.refcount == 0 && time.Now().After(e.expireAt) {
+		delete(c.entries, inum)
+		c.misses++
+		return nil, nil, false
+	}
+	c.hits++
+	return proto.Clone(e.meta).(*bangpb.InodeMeta), e.vclock, true
+}
+
+// Stats returns the cumulative hit/miss counts for Get, for exposing via
+// bangutil tracing or /metrics.
+func (c *OpenCache) Stats() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// Update overwrites the cached copy (and vclock) for inum in place, e.g.
+// after a successful Setattr/Write that changed the backend's metadata. It
+// is a no-op if inum isn't cached (nothing to keep in sync).
+func (c *OpenCache) Update(inum uint64, meta *bangpb.InodeMeta, vclock []byte) {
+	if !c.Enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[inum]; ok {
+		e.meta = proto.Clone(meta).(*bangpb.InodeMeta)
+		e.vclock = vclock
+		e.expireAt = time.Now().Add(c.ttl)
+	}
+}
+
+// Invalidate drops the cache entry for inum outright, used when a vclock
+// CAS fails (our cached copy is now known-stale) or the inode is deleted.
+func (c *OpenCache) Invalidate(inum uint64) {
+	if !c.Enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, inum)
+}
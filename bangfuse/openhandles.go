@@ -0,0 +1,47 @@
+package bangfuse
+
+import "sync"
+
+// openHandleTable tracks how many FileHandles are currently open for each
+// inode. Unlink consults it (via finalizeIfOrphaned) before deleting an
+// unlinked inode's chunks and metadata: POSIX requires the data to stay
+// reachable through descriptors that were open before the last link was
+// removed, so the delete has to wait for both Nlink==0 and no open handles,
+// whichever happens last. Unlike OpenCache this is never disabled — it's
+// load-bearing for correctness, not a perf optimization.
+type openHandleTable struct {
+	mu    sync.Mutex
+	count map[uint64]int
+}
+
+func newOpenHandleTable() *openHandleTable {
+	return &openHandleTable{count: make(map[uint64]int)}
+}
+
+// Acquire records a new open handle for inum.
+func (t *openHandleTable) Acquire(inum uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count[inum]++
+}
+
+// Release drops one open handle for inum.
+func (t *openHandleTable) Release(inum uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n := t.count[inum] - 1; n <= 0 {
+		delete(t.count, inum)
+	} else {
+		t.count[inum] = n
+	}
+}
+
+// Open reports whether inum currently has any open handles.
+func (t *openHandleTable) Open(inum uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count[inum] > 0
+}
+
+// gOpenHandles is the package-level open-handle table; see openHandleTable.
+var gOpenHandles = newOpenHandleTable()
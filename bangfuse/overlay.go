@@ -0,0 +1,759 @@
+// Optional writable overlay/union layer: a BangOverlayDirNode/
+// BangOverlayFileNode pair that composes two independent KVStores — a
+// read-only lower (e.g. a shared golden dataset) and a writable upper (e.g.
+// per-user scratch space) — instead of addressing the single package-level
+// gKVStore the rest of bangfuse relies on. Lookup/Readdir merge both sides;
+// Create/Mkdir always land in upper; Unlink/Rmdir on a lower-only entry
+// leaves a whiteout in upper instead of touching lower; writes to a
+// lower-only file trigger copy-up the first time they're needed.
+package bangfuse
+
+import (
+	"bangfs/bangutil"
+	bangpb "bangfs/proto"
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"google.golang.org/protobuf/proto"
+)
+
+// BangOverlayDirNode implements directory ops over a lower/upper KVStore
+// pair. inum is the single numeric key this directory is addressed by in
+// whichever side(s) have it — Create/Mkdir/ensureUpperDir always reuse the
+// lower number when copying a directory up, so a directory present on both
+// sides is guaranteed to share one inum rather than needing two.
+type BangOverlayDirNode struct {
+	fs.Inode
+	lower, upper       KVStore
+	inum               uint64
+	hasLower, hasUpper bool
+}
+
+// BangOverlayFileNode mirrors BangOverlayDirNode for regular files. It
+// embeds BangFileNode so that once copyUp has materialized a file into
+// upper (MountOverlay pins gKVStore to upper for the mount's lifetime), the
+// existing chunking/prefetch/Setattr-truncation machinery on BangFileNode
+// works completely unmodified — only the not-yet-copied-up path needs
+// overlay-specific handling.
+type BangOverlayFileNode struct {
+	BangFileNode
+	lower, upper KVStore
+	hasUpper     bool
+}
+
+// Verify interface compliance
+var _ = (fs.NodeLookuper)((*BangOverlayDirNode)(nil))
+var _ = (fs.NodeReaddirer)((*BangOverlayDirNode)(nil))
+var _ = (fs.NodeGetattrer)((*BangOverlayDirNode)(nil))
+var _ = (fs.NodeCreater)((*BangOverlayDirNode)(nil))
+var _ = (fs.NodeMkdirer)((*BangOverlayDirNode)(nil))
+var _ = (fs.NodeUnlinker)((*BangOverlayDirNode)(nil))
+var _ = (fs.NodeRmdirer)((*BangOverlayDirNode)(nil))
+var _ = (fs.NodeGetattrer)((*BangOverlayFileNode)(nil))
+var _ = (fs.NodeSetattrer)((*BangOverlayFileNode)(nil))
+var _ = (fs.NodeOpener)((*BangOverlayFileNode)(nil))
+
+// NewBangOverlayRoot builds the root node of an overlay mount. The root
+// always has an upper counterpart (inode 0 must exist in both backends,
+// same as the non-overlay mkbangfs convention), so ensureUpperDir never
+// needs to recurse past it.
+func NewBangOverlayRoot(lower, upper KVStore) *BangOverlayDirNode {
+	return &BangOverlayDirNode{lower: lower, upper: upper, inum: 0, hasLower: true, hasUpper: true}
+}
+
+// childEntriesOf is childEntries generalized to an explicit KVStore instead
+// of the package-level gKVStore, needed here because overlay nodes address
+// two independent backends at once.
+func childEntriesOf(kv KVStore, inum uint64, dir_meta *bangpb.InodeMeta) ([]*bangpb.ChildEntry, error) {
+	dentryMode, err := kv.DentryMode()
+	if err != nil {
+		return nil, fmt.Errorf("checking dentry mode: %w", err)
+	}
+	if !dentryMode {
+		return dir_meta.GetChildEntries(), nil
+	}
+	return kv.ListChildren(inum)
+}
+
+// metadataFor fetches inum's metadata, preferring upper (the more likely to
+// be current of the two once anything has been copied up).
+func (d *BangOverlayDirNode) metadataFor(inum uint64) (*bangpb.InodeMeta, []byte, error) {
+	if d.hasUpper {
+		if meta, vclock, err := d.upper.Metadata(inum); err == nil {
+			return meta, vclock, nil
+		}
+	}
+	return d.lower.Metadata(inum)
+}
+
+// resolveChild looks up name on both sides independently — rather than
+// reporting a single "winning" side — because Rmdir's emptiness check needs
+// to merge a target's children from both sides at once, and Unlink needs to
+// know whether a lower entry exists even when an upper entry also does, so
+// it can leave a whiteout instead of just deleting the upper copy. A name
+// whiteout-marked in upper is reported not found regardless of lower.
+func (d *BangOverlayDirNode) resolveChild(name string) (inum uint64, hasLower, hasUpper, found bool, err error) {
+	if d.hasUpper {
+		upperMeta, _, merr := d.upper.Metadata(d.inum)
+		if merr != nil {
+			return 0, false, false, false, fmt.Errorf("getting upper dir metadata: %w", merr)
+		}
+		upperEntries, merr := childEntriesOf(d.upper, d.inum, upperMeta)
+		if merr != nil {
+			return 0, false, false, false, merr
+		}
+		if e := findChildEntry(upperEntries, name); e != nil {
+			if e.Whiteout {
+				return 0, false, false, false, nil
+			}
+			inum, hasUpper = e.Inode, true
+		}
+	}
+	if d.hasLower {
+		lowerMeta, _, merr := d.lower.Metadata(d.inum)
+		if merr != nil {
+			return 0, false, false, false, fmt.Errorf("getting lower dir metadata: %w", merr)
+		}
+		lowerEntries, merr := childEntriesOf(d.lower, d.inum, lowerMeta)
+		if merr != nil {
+			return 0, false, false, false, merr
+		}
+		if e := findChildEntry(lowerEntries, name); e != nil {
+			hasLower = true
+			if !hasUpper {
+				inum = e.Inode
+			}
+		}
+	}
+	found = hasUpper || hasLower
+	return
+}
+
+// merged returns the union of both sides' children, upper taking priority
+// and upper whiteouts masking lower entries of the same name.
+func (d *BangOverlayDirNode) merged() ([]*bangpb.ChildEntry, error) {
+	byName := map[string]*bangpb.ChildEntry{}
+	if d.hasLower {
+		lowerMeta, _, err := d.lower.Metadata(d.inum)
+		if err != nil {
+			return nil, fmt.Errorf("getting lower dir metadata: %w", err)
+		}
+		lowerEntries, err := childEntriesOf(d.lower, d.inum, lowerMeta)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range lowerEntries {
+			byName[c.Name] = c
+		}
+	}
+	if d.hasUpper {
+		upperMeta, _, err := d.upper.Metadata(d.inum)
+		if err != nil {
+			return nil, fmt.Errorf("getting upper dir metadata: %w", err)
+		}
+		upperEntries, err := childEntriesOf(d.upper, d.inum, upperMeta)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range upperEntries {
+			if c.Whiteout {
+				delete(byName, c.Name)
+				continue
+			}
+			byName[c.Name] = c
+		}
+	}
+	out := make([]*bangpb.ChildEntry, 0, len(byName))
+	for _, c := range byName {
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// touchUpperDir is touchDir's KVStore-parametrized twin: overlay nodes
+// address an explicit upper store instead of the package-level gKVStore
+// that touchDir assumes.
+func touchUpperDir(kv KVStore, inum uint64, now int64) error {
+	meta, vclock, err := kv.Metadata(inum)
+	if err != nil {
+		return fmt.Errorf("getting dir metadata: %w", err)
+	}
+	meta.MtimeNs = now
+	meta.CtimeNs = now
+	if _, err := kv.UpdateMetadata(inum, meta, vclock); err != nil {
+		return fmt.Errorf("updating dir metadata: %w", err)
+	}
+	return nil
+}
+
+// putUpperChildEntry adds or replaces entry in this directory's upper-side
+// child list (used for real entries and for whiteout tombstones alike).
+func (d *BangOverlayDirNode) putUpperChildEntry(entry *bangpb.ChildEntry, now int64) error {
+	dentryMode, err := d.upper.DentryMode()
+	if err != nil {
+		return fmt.Errorf("checking upper dentry mode: %w", err)
+	}
+	if dentryMode {
+		if err := d.upper.PutDentry(d.inum, entry); err != nil {
+			return fmt.Errorf("storing upper dentry: %w", err)
+		}
+		return touchUpperDir(d.upper, d.inum, now)
+	}
+	meta, vclock, err := d.upper.Metadata(d.inum)
+	if err != nil {
+		return fmt.Errorf("getting upper dir metadata: %w", err)
+	}
+	meta.ChildEntries = append(withoutChildEntry(meta.GetChildEntries(), entry.Name), entry)
+	meta.MtimeNs = now
+	meta.CtimeNs = now
+	if _, err := d.upper.UpdateMetadata(d.inum, meta, vclock); err != nil {
+		return fmt.Errorf("updating upper dir metadata: %w", err)
+	}
+	return nil
+}
+
+// deleteUpperChildEntry removes name from this directory's upper-side
+// child list outright (used when removing an upper-only entry, where no
+// whiteout is needed since lower never had the name to begin with).
+func (d *BangOverlayDirNode) deleteUpperChildEntry(name string, now int64) error {
+	dentryMode, err := d.upper.DentryMode()
+	if err != nil {
+		return fmt.Errorf("checking upper dentry mode: %w", err)
+	}
+	if dentryMode {
+		if err := d.upper.DeleteDentry(d.inum, name); err != nil {
+			return fmt.Errorf("deleting upper dentry: %w", err)
+		}
+		return touchUpperDir(d.upper, d.inum, now)
+	}
+	meta, vclock, err := d.upper.Metadata(d.inum)
+	if err != nil {
+		return fmt.Errorf("getting upper dir metadata: %w", err)
+	}
+	meta.ChildEntries = withoutChildEntry(meta.GetChildEntries(), name)
+	meta.MtimeNs = now
+	meta.CtimeNs = now
+	if _, err := d.upper.UpdateMetadata(d.inum, meta, vclock); err != nil {
+		return fmt.Errorf("updating upper dir metadata: %w", err)
+	}
+	return nil
+}
+
+// ensureUpperDir makes sure this directory has an upper-side counterpart,
+// cloning one from lower's own metadata (sans children) and wiring it into
+// the parent's upper child list if needed. Recurses toward the root, which
+// always has an upper counterpart from NewBangOverlayRoot, so the
+// recursion is bounded by tree depth.
+func (d *BangOverlayDirNode) ensureUpperDir() error {
+	if d.hasUpper {
+		return nil
+	}
+
+	lowerMeta, _, err := d.lower.Metadata(d.inum)
+	if err != nil {
+		return fmt.Errorf("getting lower dir metadata for copy-up: %w", err)
+	}
+	upperMeta := proto.Clone(lowerMeta).(*bangpb.InodeMeta)
+	upperMeta.ChildEntries = []*bangpb.ChildEntry{}
+
+	if _, err := d.upper.PutMetadata(d.inum, upperMeta); err != nil {
+		return fmt.Errorf("storing copied-up dir metadata: %w", err)
+	}
+
+	if parentName, parentInode := d.EmbeddedInode().Parent(); parentInode != nil {
+		if parentOps, ok := parentInode.Operations().(*BangOverlayDirNode); ok {
+			if err := parentOps.ensureUpperDir(); err != nil {
+				return err
+			}
+			if err := parentOps.putUpperChildEntry(&bangpb.ChildEntry{Name: parentName, Inode: d.inum, Mode: upperMeta.Mode}, time.Now().UnixNano()); err != nil {
+				return err
+			}
+		}
+	}
+
+	d.hasUpper = true
+	return nil
+}
+
+// Lookup resolves name against upper then lower (see resolveChild) and
+// hands back a BangOverlayDirNode or BangOverlayFileNode carrying both
+// sides' presence for that child. Symlinks aren't given an overlay node
+// type — out of scope for this feature, same as Link not following them.
+func (d *BangOverlayDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	op := bangutil.GetTracer().Op("Lookup", d.inum, name)
+
+	inum, hasLower, hasUpper, found, err := d.resolveChild(name)
+	if err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
+	if !found {
+		return nil, syscall.ENOENT
+	}
+
+	meta, _, err := d.metadataForChild(inum, hasUpper)
+	if err != nil {
+		op.Error(fmt.Errorf("getting child metadata: %v", err))
+		return nil, syscall.EIO
+	}
+
+	op.Done()
+	switch {
+	case IsDir(meta):
+		return d.NewInode(ctx, &BangOverlayDirNode{
+			lower: d.lower, upper: d.upper, inum: inum,
+			hasLower: hasLower, hasUpper: hasUpper,
+		}, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: inum}), 0
+	case IsFile(meta):
+		return d.NewInode(ctx, &BangOverlayFileNode{
+			lower: d.lower, upper: d.upper, hasUpper: hasUpper,
+		}, fs.StableAttr{Mode: fuse.S_IFREG, Ino: inum}), 0
+	default:
+		op.Error(fmt.Errorf("overlay only supports directories and regular files"))
+		return nil, syscall.ENOTSUP
+	}
+}
+
+// metadataForChild fetches a resolved child's metadata, preferring upper
+// when hasUpper says the child is actually there.
+func (d *BangOverlayDirNode) metadataForChild(inum uint64, hasUpper bool) (*bangpb.InodeMeta, []byte, error) {
+	if hasUpper {
+		return d.upper.Metadata(inum)
+	}
+	return d.lower.Metadata(inum)
+}
+
+// Readdir merges both sides' children (see merged) and prepends . and ..,
+// same shape as BangDirNode.Readdir before the dentry-count grows large
+// enough to matter for a scratch/overlay mount.
+func (d *BangOverlayDirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	op := bangutil.GetTracer().Op("Readdir", d.inum, "")
+
+	selfMeta, _, err := d.metadataFor(d.inum)
+	if err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
+	children, err := d.merged()
+	if err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
+
+	entries := make([]fuse.DirEntry, 0, len(children)+2)
+	entries = append(entries, fuse.DirEntry{Name: ".", Ino: d.inum, Mode: selfMeta.Mode})
+	entries = append(entries, fuse.DirEntry{Name: "..", Ino: selfMeta.ParentInode, Mode: syscall.S_IFDIR})
+	for _, c := range children {
+		mode := c.Mode
+		if mode == 0 {
+			meta, _, merr := d.metadataFor(c.Inode)
+			if merr != nil {
+				op.Error(merr)
+				return nil, syscall.EIO
+			}
+			mode = meta.Mode
+		}
+		entries = append(entries, fuse.DirEntry{Ino: c.Inode, Name: c.Name, Mode: mode})
+	}
+
+	op.Done()
+	return fs.NewListDirStream(entries), 0
+}
+
+// Getattr reports attributes from whichever side is authoritative.
+func (d *BangOverlayDirNode) Getattr(ctx context.Context, _ fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	meta, _, err := d.metadataFor(d.inum)
+	if err != nil {
+		return syscall.EIO
+	}
+	MetadataToFuseAttr(d.inum, meta, &out.Attr)
+	return 0
+}
+
+// Create always lands the new file in upper, copying this directory up
+// first if it doesn't have an upper counterpart yet.
+func (d *BangOverlayDirNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	op := bangutil.GetTracer().Op("Create", d.inum, name)
+
+	_, _, _, found, err := d.resolveChild(name)
+	if err != nil {
+		op.Error(err)
+		return nil, nil, 0, syscall.EIO
+	}
+	if found {
+		return nil, nil, 0, syscall.EEXIST
+	}
+	if err := d.ensureUpperDir(); err != nil {
+		op.Error(err)
+		return nil, nil, 0, syscall.EIO
+	}
+
+	now := time.Now().UnixNano()
+	newInum, err := gInumgen.NextId()
+	if err != nil {
+		op.Error(fmt.Errorf("generating inode id: %v", err))
+		return nil, nil, 0, syscall.EIO
+	}
+	newMeta := &bangpb.InodeMeta{
+		Name:        name,
+		ParentInode: d.inum,
+		Mode:        mode | syscall.S_IFREG,
+		Uid:         uint32(os.Getuid()),
+		Gid:         uint32(os.Getgid()),
+		CtimeNs:     now,
+		MtimeNs:     now,
+		AtimeNs:     now,
+		Chunks:      []*bangpb.ChunkRef{},
+		Nlink:       1,
+	}
+	newVclock, err := d.upper.PutMetadata(newInum, newMeta)
+	if err != nil {
+		op.Error(fmt.Errorf("storing the new file metadata: %v", err))
+		return nil, nil, 0, syscall.EIO
+	}
+	if err := d.putUpperChildEntry(&bangpb.ChildEntry{Name: name, Inode: newInum, Mode: newMeta.Mode}, now); err != nil {
+		op.Error(err)
+		return nil, nil, 0, syscall.EIO
+	}
+
+	inode := d.NewInode(ctx, &BangOverlayFileNode{lower: d.lower, upper: d.upper, hasUpper: true}, fs.StableAttr{Mode: syscall.S_IFREG, Ino: newInum})
+	fh := &BangFH{Inum: newInum, VClock: newVclock, Metadata: newMeta, Flags: flags, pages: newPageBuffer(), prefetch: newPrefetchState()}
+
+	op.Done()
+	return inode, fh, 0, 0
+}
+
+// Mkdir always lands the new directory in upper, same as Create.
+func (d *BangOverlayDirNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	op := bangutil.GetTracer().Op("Mkdir", d.inum, name)
+
+	_, _, _, found, err := d.resolveChild(name)
+	if err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
+	if found {
+		return nil, syscall.EEXIST
+	}
+	if err := d.ensureUpperDir(); err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
+
+	now := time.Now().UnixNano()
+	newInum, err := gInumgen.NextId()
+	if err != nil {
+		op.Error(fmt.Errorf("generating inode id: %v", err))
+		return nil, syscall.EIO
+	}
+	newMeta := &bangpb.InodeMeta{
+		Name:         name,
+		ParentInode:  d.inum,
+		Mode:         mode | syscall.S_IFDIR,
+		Uid:          uint32(os.Getuid()),
+		Gid:          uint32(os.Getgid()),
+		CtimeNs:      now,
+		MtimeNs:      now,
+		AtimeNs:      now,
+		ChildEntries: []*bangpb.ChildEntry{},
+		Nlink:        2,
+	}
+	if _, err := d.upper.PutMetadata(newInum, newMeta); err != nil {
+		op.Error(fmt.Errorf("storing the new dir metadata: %v", err))
+		return nil, syscall.EIO
+	}
+	if err := d.putUpperChildEntry(&bangpb.ChildEntry{Name: name, Inode: newInum, Mode: newMeta.Mode}, now); err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
+
+	inode := d.NewInode(ctx, &BangOverlayDirNode{
+		lower: d.lower, upper: d.upper, inum: newInum, hasUpper: true,
+	}, fs.StableAttr{Mode: syscall.S_IFDIR, Ino: newInum})
+	op.Done()
+	return inode, 0
+}
+
+// Unlink removes name. If it only exists in upper it's deleted outright;
+// if lower also has it, a whiteout is left in upper instead so the lower
+// entry doesn't reappear on the next Lookup/Readdir.
+func (d *BangOverlayDirNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	op := bangutil.GetTracer().Op("Unlink", d.inum, name)
+
+	inum, hasLower, hasUpper, found, err := d.resolveChild(name)
+	if err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
+	if !found {
+		return syscall.ENOENT
+	}
+
+	now := time.Now().UnixNano()
+	if err := d.ensureUpperDir(); err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
+
+	if hasLower {
+		if err := d.putUpperChildEntry(&bangpb.ChildEntry{Name: name, Whiteout: true}, now); err != nil {
+			op.Error(err)
+			return syscall.EIO
+		}
+	} else if err := d.deleteUpperChildEntry(name, now); err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
+
+	if hasUpper {
+		meta, vclock, err := d.upper.Metadata(inum)
+		if err != nil {
+			op.Error(fmt.Errorf("getting unlinked file metadata: %v", err))
+			return syscall.EIO
+		}
+		meta.Nlink--
+		meta.CtimeNs = now
+		if _, err := d.upper.UpdateMetadata(inum, meta, vclock); err != nil {
+			op.Error(fmt.Errorf("decrementing nlink on unlinked file: %v", err))
+			return syscall.EIO
+		}
+		// TODO: reclaim the upper inode (metadata + chunks) once Nlink
+		// reaches zero and no handles remain open, mirroring
+		// finalizeIfOrphaned — needs an overlay-aware equivalent of
+		// gOpenHandles scoped per-backend rather than per-gKVStore.
+	}
+
+	op.Done()
+	return 0
+}
+
+// Rmdir removes an empty directory, checking emptiness across both sides
+// (see merged) since copy-up can leave live children on one side even
+// though the other side's whiteouts mask them from a single-store count.
+func (d *BangOverlayDirNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	op := bangutil.GetTracer().Op("Rmdir", d.inum, name)
+
+	inum, hasLower, hasUpper, found, err := d.resolveChild(name)
+	if err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
+	if !found {
+		return syscall.ENOENT
+	}
+
+	child := &BangOverlayDirNode{lower: d.lower, upper: d.upper, inum: inum, hasLower: hasLower, hasUpper: hasUpper}
+	children, err := child.merged()
+	if err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
+	if len(children) > 0 {
+		op.Error(fmt.Errorf("directory not empty"))
+		return syscall.ENOTEMPTY
+	}
+
+	now := time.Now().UnixNano()
+	if err := d.ensureUpperDir(); err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
+
+	if hasLower {
+		if err := d.putUpperChildEntry(&bangpb.ChildEntry{Name: name, Whiteout: true}, now); err != nil {
+			op.Error(err)
+			return syscall.EIO
+		}
+	} else if err := d.deleteUpperChildEntry(name, now); err != nil {
+		op.Error(err)
+		return syscall.EIO
+	}
+
+	if hasUpper {
+		if _, vclock, err := d.upper.Metadata(inum); err == nil {
+			if err := d.upper.DeleteMetadata(inum, vclock); err != nil {
+				op.Debugf("deleting upper dir metadata for %q: %v", name, err)
+			}
+		}
+	}
+
+	op.Done()
+	return 0
+}
+
+// activeInum is the inode number this file is addressed by in whichever
+// side currently holds the authoritative copy. By invariant copyUp reuses
+// the exact same numeric key in upper as the file already had in lower, so
+// this is also always the kernel-visible StableAttr().Ino.
+func (f *BangOverlayFileNode) activeInum() uint64 {
+	return f.StableAttr().Ino
+}
+
+// Getattr reports attributes from lower until copyUp has run.
+func (f *BangOverlayFileNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if f.hasUpper {
+		return f.BangFileNode.Getattr(ctx, fh, out)
+	}
+	inum := f.activeInum()
+	meta, _, err := f.lower.Metadata(inum)
+	if err != nil {
+		return syscall.EIO
+	}
+	MetadataToFuseAttr(inum, meta, &out.Attr)
+	return 0
+}
+
+// Setattr always modifies the file (chmod, truncate, utimes, ...), so it
+// copies up first if needed, then delegates to BangFileNode as usual.
+func (f *BangOverlayFileNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if !f.hasUpper {
+		if err := f.copyUp(); err != nil {
+			return syscall.EIO
+		}
+	}
+	return f.BangFileNode.Setattr(ctx, fh, in, out)
+}
+
+// Open serves a read-only open on a not-yet-copied-up file straight from
+// lower via lowerReadFH, without paying for copy-up until a write is
+// actually requested (O_WRONLY/O_RDWR/O_TRUNC all modify the file).
+func (f *BangOverlayFileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if f.hasUpper {
+		return f.BangFileNode.Open(ctx, flags)
+	}
+
+	writeIntent := flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 || flags&uint32(syscall.O_TRUNC) != 0
+	if writeIntent {
+		if err := f.copyUp(); err != nil {
+			return nil, 0, syscall.EIO
+		}
+		return f.BangFileNode.Open(ctx, flags)
+	}
+
+	inum := f.activeInum()
+	meta, _, err := f.lower.Metadata(inum)
+	if err != nil {
+		return nil, 0, syscall.EIO
+	}
+	return &lowerReadFH{lower: f.lower, meta: meta}, 0, 0
+}
+
+// copyUp materializes this file's InodeMeta and every non-hole chunk from
+// lower into upper, reusing the same numeric inode key (required — the
+// kernel-visible inode number can't change once NewInode has assigned it)
+// and the same content-addressed chunk keys, so no chunk re-hashing is
+// needed, just a read from one backend and a write to the other. Once this
+// returns, every BangFileNode operation on f works exactly as if the file
+// had always lived in upper.
+func (f *BangOverlayFileNode) copyUp() error {
+	if f.hasUpper {
+		return nil
+	}
+	inum := f.activeInum()
+
+	lowerMeta, _, err := f.lower.Metadata(inum)
+	if err != nil {
+		return fmt.Errorf("getting lower file metadata for copy-up: %w", err)
+	}
+	upperMeta := proto.Clone(lowerMeta).(*bangpb.InodeMeta)
+
+	for _, chk := range upperMeta.Chunks {
+		if chk.Hole {
+			continue
+		}
+		data, err := f.lower.Chunk(chk.Hash)
+		if err != nil {
+			return fmt.Errorf("reading chunk %d for copy-up: %w", chk.Hash, err)
+		}
+		if err := f.upper.PutChunk(chk.Hash, data); err != nil {
+			return fmt.Errorf("writing copied-up chunk %d: %w", chk.Hash, err)
+		}
+	}
+
+	if _, err := f.upper.PutMetadata(inum, upperMeta); err != nil {
+		return fmt.Errorf("storing copied-up file metadata: %w", err)
+	}
+
+	if parentName, parentInode := f.EmbeddedInode().Parent(); parentInode != nil {
+		if parentOps, ok := parentInode.Operations().(*BangOverlayDirNode); ok {
+			if err := parentOps.ensureUpperDir(); err != nil {
+				return err
+			}
+			if err := parentOps.putUpperChildEntry(&bangpb.ChildEntry{Name: parentName, Inode: inum, Mode: upperMeta.Mode}, time.Now().UnixNano()); err != nil {
+				return err
+			}
+		}
+	}
+
+	f.hasUpper = true
+	return nil
+}
+
+// lowerReadFH serves reads for a file that hasn't been copied up yet,
+// straight from lower, without the write-path machinery (chunk splitting,
+// prefetch, ...) a BangFH carries — that only gets wired up once copyUp has
+// run and Open hands back a real BangFH instead.
+type lowerReadFH struct {
+	lower KVStore
+	meta  *bangpb.InodeMeta
+}
+
+var _ = (fs.FileReader)((*lowerReadFH)(nil))
+
+// Read walks meta.Chunks the same way BangFH.Read does, materializing hole
+// chunks as zeros, but against the fixed lower snapshot instead of a live,
+// writable f.Metadata.
+func (h *lowerReadFH) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	filesize := int64(h.meta.Size)
+	if off >= filesize {
+		return fuse.ReadResultData(nil), 0
+	}
+
+	end := off + int64(len(dest))
+	if end > filesize {
+		end = filesize
+	}
+
+	chks := h.meta.Chunks
+	buf := make([]byte, 0, end-off)
+
+	var chunk_offset int64
+	for _, chk := range chks {
+		chunk_end := chunk_offset + int64(chk.Size)
+
+		if chunk_end <= off {
+			chunk_offset = chunk_end
+			continue
+		}
+		if chunk_offset >= end {
+			break
+		}
+
+		slice_start := int64(0)
+		if off > chunk_offset {
+			slice_start = off - chunk_offset
+		}
+		slice_end := int64(chk.Size)
+		if end < chunk_end {
+			slice_end = end - chunk_offset
+		}
+
+		if chk.Hole {
+			buf = append(buf, make([]byte, slice_end-slice_start)...)
+		} else {
+			data, err := h.lower.Chunk(chk.Hash)
+			if err != nil {
+				return fuse.ReadResultData(nil), syscall.EIO
+			}
+			buf = append(buf, data[slice_start:slice_end]...)
+		}
+		chunk_offset = chunk_end
+	}
+
+	return fuse.ReadResultData(buf), 0
+}
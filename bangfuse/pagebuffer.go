@@ -0,0 +1,193 @@
+package bangfuse
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"bangfs/bangutil"
+	bangpb "bangfs/proto"
+)
+
+// flushWorkers bounds how many chunks a single flush uploads concurrently.
+const flushWorkers = 8
+
+// pageEntry is one dirty chunk's not-yet-uploaded bytes, plus the key of
+// the chunk it replaced (if any) so flush can drop that old chunk's
+// reference once the new one is safely durable.
+type pageEntry struct {
+	data     []byte
+	oldHash  uint64
+	replaces bool
+}
+
+// pageBuffer coalesces dirty chunk bytes for one open BangFH so that a run
+// of small Write calls only costs one PutChunk per touched chunk (instead of
+// one per call) and one writeMeta, deferred until flush. Entries are keyed
+// by *bangpb.ChunkRef rather than chunk index: replaceChunk mutates a
+// ChunkRef in place and appendChunk's new ref is only ever appended, so both
+// stay stable across the index-shifting splices splitHole performs on
+// intervening writes to the same handle.
+type pageBuffer struct {
+	mu    sync.Mutex
+	dirty map[*bangpb.ChunkRef]pageEntry
+}
+
+func newPageBuffer() *pageBuffer {
+	return &pageBuffer{dirty: make(map[*bangpb.ChunkRef]pageEntry)}
+}
+
+// stage records data as the not-yet-uploaded content for ref, overwriting
+// any previous staged content for the same ref. oldHash/replaces identify
+// the chunk key ref used to point at (zero value if ref is brand new, from
+// appendChunk) so flush can release that reference once data is durable.
+func (pb *pageBuffer) stage(ref *bangpb.ChunkRef, data []byte, oldHash uint64, replaces bool) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.dirty[ref] = pageEntry{data: data, oldHash: oldHash, replaces: replaces}
+}
+
+// lookup returns the staged (not yet durable) bytes for ref, if any.
+func (pb *pageBuffer) lookup(ref *bangpb.ChunkRef) ([]byte, bool) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	entry, ok := pb.dirty[ref]
+	return entry.data, ok
+}
+
+// empty reports whether there is nothing to flush.
+func (pb *pageBuffer) empty() bool {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	return len(pb.dirty) == 0
+}
+
+// size returns the total bytes currently buffered, used to trigger an
+// automatic flush once the buffer grows past a threshold.
+func (pb *pageBuffer) size() int {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	n := 0
+	for _, e := range pb.dirty {
+		n += len(e.data)
+	}
+	return n
+}
+
+// snapshot copies the current dirty set out from under the lock so a flush
+// can upload it without blocking concurrent Write/Read calls that stage
+// further (different) chunks in the meantime.
+func (pb *pageBuffer) snapshot() map[*bangpb.ChunkRef]pageEntry {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	out := make(map[*bangpb.ChunkRef]pageEntry, len(pb.dirty))
+	for ref, entry := range pb.dirty {
+		out[ref] = entry
+	}
+	return out
+}
+
+// clear drops exactly the entries in flushed, leaving alone anything staged
+// after the snapshot was taken.
+func (pb *pageBuffer) clear(flushed map[*bangpb.ChunkRef]pageEntry) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	for ref := range flushed {
+		delete(pb.dirty, ref)
+	}
+}
+
+// maxBufferedBytes triggers an automatic flush from Write once exceeded, so
+// a long run of writes without an explicit fsync can't grow pages without
+// bound.
+const maxBufferedBytes = 8 * gChunksize
+
+// flush uploads every staged chunk in parallel (bounded by flushWorkers),
+// then issues a single writeMeta for the chunk refs they belong to. If
+// writeMeta loses a vclock race, metadata is resynced and this flush's refs
+// are best-effort replayed into the fresh Chunks list before one retry —
+// like the Setattr truncate path, a racing structural change elsewhere
+// (e.g. a concurrent truncate) can still leave a replayed ref orphaned.
+func (f *BangFH) flush(ctx context.Context) error {
+	op := bangutil.GetTracer().Op("flush", f.Inum, f.Metadata.Name)
+
+	pending := f.pages.snapshot()
+	if len(pending) == 0 {
+		op.Done()
+		return nil
+	}
+
+	type job struct {
+		ref   *bangpb.ChunkRef
+		entry pageEntry
+	}
+	jobs := make(chan job, len(pending))
+	for ref, entry := range pending {
+		jobs <- job{ref, entry}
+	}
+	close(jobs)
+
+	class := StorageClassOf(f.Metadata)
+	workers := flushWorkers
+	if workers > len(pending) {
+		workers = len(pending)
+	}
+	errs := make(chan error, len(pending))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := putChunkForClass(class, j.ref.Hash, j.entry.data); err != nil {
+					errs <- fmt.Errorf("flush chunk %016x: %w", j.ref.Hash, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		// Leave pending staged so a later flush retries it; nothing has
+		// been written to metadata yet, so the backend is still consistent.
+		op.Error(err)
+		return err
+	}
+
+	if err := f.writeMeta(ctx); err != nil {
+		op.Debugf("writeMeta conflict during flush, resyncing and replaying %d chunk ref(s): %v", len(pending), err)
+		if rerr := f.resyncMetadata(ctx); rerr != nil {
+			op.Error(rerr)
+			return fmt.Errorf("flush: resync after writeMeta conflict: %w", rerr)
+		}
+		for ref := range pending {
+			f.Metadata.Chunks = append(f.Metadata.Chunks, ref)
+		}
+		if err := f.writeMeta(ctx); err != nil {
+			op.Error(err)
+			return fmt.Errorf("flush: writeMeta retry after resync: %w", err)
+		}
+	}
+
+	f.pages.clear(pending)
+
+	// Now that the new chunks are durable and metadata points at them,
+	// release the reference each replaceChunk-staged entry held on the
+	// chunk it overwrote; done best-effort, same as Setattr's truncate path.
+	for ref, entry := range pending {
+		if !entry.replaces {
+			continue
+		}
+		if ref.Hash == entry.oldHash {
+			continue // replaceChunk wrote back the same content/key; nothing to release
+		}
+		if err := gKVStore.DeleteChunk(entry.oldHash); err != nil {
+			op.Debugf("failed to release overwritten chunk %016x, queuing for retry: %v", entry.oldHash, err)
+			gChunkGC.Enqueue(entry.oldHash)
+		}
+	}
+
+	op.Done()
+	return nil
+}
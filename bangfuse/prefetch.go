@@ -0,0 +1,171 @@
+package bangfuse
+
+import (
+	"sync"
+
+	"bangfs/bangutil"
+
+	bangpb "bangfs/proto"
+)
+
+// chunkCacheCapacity bounds how many chunks a single BangFH keeps around for
+// prefetch/read-modify-write reuse. Capacity is per-handle, not per-file, so
+// it stays small regardless of file size.
+const chunkCacheCapacity = 32
+
+const (
+	minPrefetchWindow = 2
+	maxPrefetchWindow = 16
+)
+
+// chunkCache is a bounded LRU of chunk bytes keyed by content key
+// (bangutil.ChunkKey, i.e. ChunkRef.Hash), shared by BangFH.readChunk for
+// both prefetched-ahead chunks and ordinary reads, so writeAt's
+// read-modify-write path benefits from it too without any special-casing.
+// It's keyed by content key rather than *bangpb.ChunkRef pointer identity
+// because replaceChunk mutates a ChunkRef's Hash in place (same pointer,
+// new content) on overwrite; a pointer-keyed cache would keep serving the
+// pre-write bytes under that unchanged pointer after a flush.
+type chunkCache struct {
+	mu       sync.Mutex
+	capacity int
+	data     map[uint64][]byte
+	order    []uint64 // least-recently-used first
+}
+
+func newChunkCache(capacity int) *chunkCache {
+	return &chunkCache{capacity: capacity, data: make(map[uint64][]byte)}
+}
+
+func (c *chunkCache) get(key uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[key]
+	if ok {
+		c.touchLocked(key)
+	}
+	return data, ok
+}
+
+// put inserts or refreshes key's cached bytes, evicting the least-recently
+// used entry once the cache grows past capacity.
+func (c *chunkCache) put(key uint64, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.data[key]; exists {
+		c.data[key] = data
+		c.touchLocked(key)
+		return
+	}
+	c.data[key] = data
+	c.order = append(c.order, key)
+	for len(c.order) > c.capacity {
+		evict := c.order[0]
+		c.order = c.order[1:]
+		delete(c.data, evict)
+		bangutil.GetTracer().RecordKVOp("PrefetchEviction", 0, 0, 0, nil)
+	}
+}
+
+func (c *chunkCache) touchLocked(key uint64) {
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, key)
+}
+
+// prefetchState tracks one BangFH's access pattern (to detect sequential
+// reads) and the in-flight set of chunks currently being fetched ahead, plus
+// the chunkCache their results land in.
+type prefetchState struct {
+	mu       sync.Mutex
+	lastEnd  int64
+	window   int
+	inFlight map[int]bool
+	cache    *chunkCache
+}
+
+func newPrefetchState() *prefetchState {
+	return &prefetchState{
+		window:   minPrefetchWindow,
+		inFlight: make(map[int]bool),
+		cache:    newChunkCache(chunkCacheCapacity),
+	}
+}
+
+// observe records a read of [off, end) and reports whether it was
+// sequential (immediately follows the previous read) along with the
+// current prefetch window size: the window grows by one chunk on each
+// sequential hit (capped at maxPrefetchWindow) and resets to
+// minPrefetchWindow the moment access stops being sequential, so a random
+// workload doesn't keep paying for read-ahead it isn't using.
+func (ps *prefetchState) observe(off, end int64) (sequential bool, window int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sequential = off == ps.lastEnd
+	if sequential {
+		if ps.window < maxPrefetchWindow {
+			ps.window++
+		}
+	} else {
+		ps.window = minPrefetchWindow
+	}
+	ps.lastEnd = end
+	return sequential, ps.window
+}
+
+// tryClaim marks chunk idx as being prefetched, returning false if it's
+// already in flight (another prefetch or the current Read call is already
+// fetching it).
+func (ps *prefetchState) tryClaim(idx int) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.inFlight[idx] {
+		return false
+	}
+	ps.inFlight[idx] = true
+	return true
+}
+
+func (ps *prefetchState) release(idx int) {
+	ps.mu.Lock()
+	delete(ps.inFlight, idx)
+	ps.mu.Unlock()
+}
+
+// prefetchAhead fires off up to window parallel gKVStore.Chunk fetches for
+// the non-hole chunks at indices [startIdx, startIdx+window), stashing
+// results in f.prefetch.cache for a later readChunk to pick up. It doesn't
+// block the calling Read: results that arrive after the caller has already
+// moved on just warm the cache for the next one.
+func (f *BangFH) prefetchAhead(startIdx, window int) {
+	chks := f.Metadata.Chunks
+	limit := startIdx + window
+	if limit > len(chks) {
+		limit = len(chks)
+	}
+	for i := startIdx; i < limit; i++ {
+		ref := chks[i]
+		if ref.Hole {
+			continue
+		}
+		if _, ok := f.prefetch.cache.get(ref.Hash); ok {
+			continue
+		}
+		if !f.prefetch.tryClaim(i) {
+			continue
+		}
+		go func(idx int, ref *bangpb.ChunkRef) {
+			defer f.prefetch.release(idx)
+			data, err := gKVStore.Chunk(ref.Hash)
+			if err != nil {
+				bangutil.GetTracer().Op("prefetch", f.Inum, f.Metadata.Name).Errorf("prefetch chunk %d: %v", idx, err)
+				return
+			}
+			f.prefetch.cache.put(ref.Hash, data)
+		}(i, ref)
+	}
+}
@@ -0,0 +1,63 @@
+package bangfuse
+
+import (
+	"testing"
+)
+
+func TestChunkCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newChunkCache(2)
+	var a, b, d uint64 = 1, 2, 3
+
+	c.put(a, []byte("a"))
+	c.put(b, []byte("b"))
+	if _, ok := c.get(a); !ok {
+		t.Fatal("expected a to still be cached")
+	}
+
+	// a was just touched, so inserting d should evict b (least recently used).
+	c.put(d, []byte("d"))
+	if _, ok := c.get(b); ok {
+		t.Error("expected b to have been evicted")
+	}
+	if _, ok := c.get(a); !ok {
+		t.Error("expected a to still be cached")
+	}
+	if _, ok := c.get(d); !ok {
+		t.Error("expected d to be cached")
+	}
+}
+
+func TestPrefetchState_WindowGrowsOnSequentialAccess(t *testing.T) {
+	ps := newPrefetchState()
+
+	seq, window := ps.observe(0, 10)
+	if !seq || window != minPrefetchWindow+1 {
+		t.Fatalf("first read: seq=%v window=%d, want seq=true window=%d", seq, window, minPrefetchWindow+1)
+	}
+
+	seq, window = ps.observe(10, 20)
+	if !seq || window != minPrefetchWindow+2 {
+		t.Fatalf("second sequential read: seq=%v window=%d, want seq=true window=%d", seq, window, minPrefetchWindow+2)
+	}
+
+	// A non-sequential read resets the window.
+	seq, window = ps.observe(1000, 1010)
+	if seq || window != minPrefetchWindow {
+		t.Fatalf("random read: seq=%v window=%d, want seq=false window=%d", seq, window, minPrefetchWindow)
+	}
+}
+
+func TestPrefetchState_ClaimPreventsDuplicateFetch(t *testing.T) {
+	ps := newPrefetchState()
+
+	if !ps.tryClaim(5) {
+		t.Fatal("expected first claim of idx 5 to succeed")
+	}
+	if ps.tryClaim(5) {
+		t.Fatal("expected second claim of idx 5 to fail while in flight")
+	}
+	ps.release(5)
+	if !ps.tryClaim(5) {
+		t.Fatal("expected claim of idx 5 to succeed again after release")
+	}
+}
@@ -0,0 +1,33 @@
+package bangfuse
+
+import (
+	"bangfs/bangutil"
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// BangSymlinkNode implements inode ops for a symbolic link. It reuses
+// BangFileNode's Getattr/Setattr (a symlink's own mode/size/times are plain
+// InodeMeta fields like any other inode) and adds Readlink for the target.
+type BangSymlinkNode struct {
+	BangFileNode
+}
+
+var _ = (fs.NodeReadlinker)((*BangSymlinkNode)(nil))
+
+// Readlink returns the stored symlink target.
+func (sl *BangSymlinkNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	inum := sl.StableAttr().Ino
+	op := bangutil.GetTracer().Op("Readlink", inum, "")
+
+	meta, _, err := gKVStore.Metadata(inum)
+	if err != nil {
+		op.Error(err)
+		return nil, syscall.EIO
+	}
+
+	op.Done()
+	return []byte(meta.SymlinkTarget), 0
+}
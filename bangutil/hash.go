@@ -2,11 +2,13 @@
 package bangutil
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"hash/fnv"
 )
 
 // FNV32 computes a 32-bit FNV hash of the data
-func FNV32(data []byte) uint32{
+func FNV32(data []byte) uint32 {
 	h := fnv.New32a()
 	h.Write(data)
 	return h.Sum32()
@@ -33,8 +35,22 @@ func FNV128Bytes(data []byte) []byte {
 	return h.Sum(nil)
 }
 
-// HashChunk computes the hash for a chunk of data
-// Uses FNV-1a 64-bit for speed (non-cryptographic)
+// HashChunk computes the content hash used to key a chunk for
+// content-addressed storage (see bangfuse's chunk dedup/refcounting).
+// Uses SHA-256 rather than the FNV hashes above: two unrelated chunks
+// colliding here would silently alias their storage key, so this needs
+// cryptographic collision resistance, not just speed.
 func HashChunk(data []byte) []byte {
-	return FNV64Bytes(data)
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// ChunkKey derives the uint64 backend key for a chunk from its content
+// hash (as returned by HashChunk), truncating to the first 8 bytes. The
+// full hash is still what's compared for dedup purposes where it's
+// available; this is only the per-backend lookup key.
+func ChunkKey(hash []byte) uint64 {
+	var buf [8]byte
+	copy(buf[:], hash)
+	return binary.BigEndian.Uint64(buf[:])
 }
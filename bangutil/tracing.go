@@ -15,6 +15,100 @@ type Tracer struct {
 	logger  *log.Logger
 	file    *os.File
 	mu      sync.Mutex
+
+	statsMu sync.Mutex
+	stats   map[string]*opStats
+}
+
+// LatencyBucketsSeconds are the upper bounds (in seconds) of the per-op
+// latency histogram RecordKVOp maintains alongside the sum/count counters,
+// plus an implicit trailing +Inf bucket — close enough to Prometheus's own
+// default buckets to make p50/p90/p99 usable out of the box from /metrics.
+var LatencyBucketsSeconds = []float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// bucketIndex returns the index into LatencyBucketsSeconds of the first
+// bucket whose upper bound is >= seconds, or len(LatencyBucketsSeconds) for
+// the overflow ("+Inf only") bucket.
+func bucketIndex(seconds float64) int {
+	for i, ub := range LatencyBucketsSeconds {
+		if seconds <= ub {
+			return i
+		}
+	}
+	return len(LatencyBucketsSeconds)
+}
+
+// opStats accumulates per-KV-method counters. Unlike trace logging, stats
+// collection is always on (it's cheap) regardless of Enable/Disable.
+type opStats struct {
+	count    uint64
+	errors   uint64
+	bytesIn  uint64
+	bytesOut uint64
+	totalNs  uint64
+	// buckets[i] counts calls whose latency fell in
+	// (LatencyBucketsSeconds[i-1], LatencyBucketsSeconds[i]] (or
+	// [0, LatencyBucketsSeconds[0]] for i==0); the trailing entry is the
+	// +Inf overflow bucket. Not cumulative — Stats()/callers sum as needed.
+	// Allocated lazily (len(LatencyBucketsSeconds)+1) on first observation.
+	buckets []uint64
+}
+
+// OpStats is a point-in-time snapshot of one method's counters, returned by
+// Tracer.Stats(). Buckets mirrors opStats.buckets: not cumulative, one entry
+// per LatencyBucketsSeconds plus a trailing +Inf overflow entry.
+type OpStats struct {
+	Count    uint64
+	Errors   uint64
+	BytesIn  uint64
+	BytesOut uint64
+	TotalNs  uint64
+	Buckets  []uint64
+}
+
+// RecordKVOp accumulates counters for a KVStore method call: bytesIn is the
+// size of data written (PutChunk/PutMetadataBytes/...), bytesOut the size of
+// data read back, dur the call latency, and err non-nil on failure.
+func (t *Tracer) RecordKVOp(op string, bytesIn, bytesOut int, dur time.Duration, err error) {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	if t.stats == nil {
+		t.stats = make(map[string]*opStats)
+	}
+	s, ok := t.stats[op]
+	if !ok {
+		s = &opStats{buckets: make([]uint64, len(LatencyBucketsSeconds)+1)}
+		t.stats[op] = s
+	}
+	s.count++
+	s.bytesIn += uint64(bytesIn)
+	s.bytesOut += uint64(bytesOut)
+	s.totalNs += uint64(dur.Nanoseconds())
+	s.buckets[bucketIndex(dur.Seconds())]++
+	if err != nil {
+		s.errors++
+	}
+}
+
+// Stats returns a snapshot of the accumulated per-method KV counters, keyed
+// by method name (e.g. "PutChunk").
+func (t *Tracer) Stats() map[string]OpStats {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	out := make(map[string]OpStats, len(t.stats))
+	for op, s := range t.stats {
+		out[op] = OpStats{
+			Count:    s.count,
+			Errors:   s.errors,
+			BytesIn:  s.bytesIn,
+			BytesOut: s.bytesOut,
+			TotalNs:  s.totalNs,
+			Buckets:  append([]uint64(nil), s.buckets...),
+		}
+	}
+	return out
 }
 
 var (
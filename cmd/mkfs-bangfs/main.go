@@ -3,9 +3,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 
 	"bangfs/bangfuse"
 )
@@ -31,45 +33,81 @@ func main() {
 	port := flag.Uint("port", envPortOrDefault("RIAK_PORT", 8087), "Riak port (env: RIAK_PORT)")
 	namespace := flag.String("namespace", envOrDefault("BANGFS_NAMESPACE", ""), "Filesystem namespace (env: BANGFS_NAMESPACE)")
 	dummy := flag.Bool("dummy", false, "Use file-backed store under /tmp instead of Riak")
+	dedup := flag.Bool("dedup", true, "Enable content-addressed chunk deduplication for this namespace")
+	dentryDirs := flag.Bool("dentry-dirs", false, "Store directory children as individual secondary-index-backed dentries instead of embedding them in the parent's metadata")
+	backend := flag.String("backend", "", fmt.Sprintf("Backend to use (%s); overrides -dummy/-host/-port/-namespace when set", strings.Join(bangfuse.BackendNames(), ", ")))
+	dsn := flag.String("dsn", "", "Backend-specific DSN, required with -backend (e.g. riak://host:8087/ns, file:ns, file:/var/lib/bang.db, s3://bucket/prefix?region=...)")
 
 	flag.Parse()
 
-	if *namespace == "" {
-		log.Println("Error: -namespace is required (or set BANGFS_NAMESPACE)")
-		flag.Usage()
-		os.Exit(1)
-	}
-
 	var kv bangfuse.KVStore
-	if *dummy {
+	var err error
+	switch {
+	case *backend != "":
+		if *dsn == "" {
+			log.Println("Error: -dsn is required with -backend")
+			flag.Usage()
+			os.Exit(1)
+		}
+		log.Printf("Opening %s backend (dsn=%s)", *backend, *dsn)
+		kv, err = bangfuse.OpenBackend(*backend, *dsn)
+		if err != nil {
+			log.Fatalf("Failed to open backend: %v", err)
+		}
+	case *dummy:
+		if *namespace == "" {
+			log.Println("Error: -namespace is required (or set BANGFS_NAMESPACE)")
+			flag.Usage()
+			os.Exit(1)
+		}
 		log.Printf("Using file-backed store (namespace=%s)", *namespace)
-		fkv, err := bangfuse.NewFileKVStore(*namespace)
+		kv, err = bangfuse.NewFileKVStore(*namespace)
 		if err != nil {
 			log.Fatalf("Failed to create file store: %v", err)
 		}
-		kv = fkv
-	} else {
+	default:
+		if *namespace == "" {
+			log.Println("Error: -namespace is required (or set BANGFS_NAMESPACE)")
+			flag.Usage()
+			os.Exit(1)
+		}
 		if *host == "" {
 			log.Println("Error: -host is required (or set RIAK_HOST), or use -dummy")
 			flag.Usage()
 			os.Exit(1)
 		}
 		log.Printf("Connecting to Riak at %s:%d", *host, *port)
-		rkv, err := bangfuse.NewRiakKVStore(*host, uint16(*port), *namespace)
+		kv, err = bangfuse.NewRiakKVStore(*host, uint16(*port), *namespace)
 		if err != nil {
 			log.Fatalf("Failed to connect to backend: %v", err)
 		}
-		kv = rkv
 	}
 	defer kv.Close()
 
 	// Initialize filesystem
-	log.Printf("Initializing filesystem with namespace '%s'", *namespace)
+	log.Printf("Initializing filesystem...")
 	if err := kv.InitBackend(); err != nil {
 		log.Fatalf("Failed to initialize filesystem: %v", err)
 	}
+	if err := kv.SetDedupEnabled(*dedup); err != nil {
+		log.Fatalf("Failed to set dedup setting: %v", err)
+	}
+	if err := kv.SetDentryMode(*dentryDirs); err != nil {
+		log.Fatalf("Failed to set dentry mode setting: %v", err)
+	}
 
 	log.Printf("Filesystem initialized successfully!")
+	log.Printf("  Dedup enabled: %v", *dedup)
+	log.Printf("  Dentry mode enabled: %v", *dentryDirs)
+	if *backend != "" {
+		log.Printf("\nMount with: mount-fuse-bangfs -backend %s -dsn %q -mount /your/mountpoint", *backend, *dsn)
+		return
+	}
+	if *dummy {
+		log.Printf("  Namespace: %s (file-backed)", *namespace)
+		log.Printf("\nMount with: mount-fuse-bangfs -dummy -namespace %s -mount /your/mountpoint", *namespace)
+		return
+	}
 	log.Printf("  Metadata bucket: %s_bangfs_metadata", *namespace)
 	log.Printf("  Chunk bucket:    %s_bangfs_chunks", *namespace)
 	log.Printf("\nMount with: mount-fuse-bangfs -host %s -port %d -namespace %s -mount /your/mountpoint", *host, *port, *namespace)
@@ -3,11 +3,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"bangfs/bangfuse"
@@ -35,6 +38,12 @@ func main() {
 	daemonChild := flag.Bool("daemon-child", false, "Internal flag for daemon mode")
 	trace := flag.Bool("trace", false, "Enable tracing output for debugging")
 	tracelog := flag.String("tracelog", "", "Write trace output to file instead of stderr")
+	openCache := flag.Duration("open-cache", 0, "Cache InodeMeta/vclock for open inodes for this long (0 disables caching)")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus KVStore stats on this address (e.g. :9090); empty disables it")
+	backend := flag.String("backend", "", fmt.Sprintf("Backend to use (%s); overrides -dummy/-host/-port/-namespace when set", strings.Join(bangfuse.BackendNames(), ", ")))
+	dsn := flag.String("dsn", "", "Backend-specific DSN, required with -backend (e.g. riak://host:8087/ns, file:ns, file:/var/lib/bang.db, s3://bucket/prefix?region=...)")
+	cacheMetaEntries := flag.Int("cache-meta-entries", 0, "Cache up to this many InodeMeta entries in front of the backend (0 disables)")
+	cacheChunkBytes := flag.Int64("cache-chunk-bytes", 0, "Cache up to this many bytes of chunk data in front of the backend (0 disables)")
 
 	flag.Parse()
 
@@ -50,8 +59,13 @@ func main() {
 	}
 
 	// Validate required args
-	if *namespace == "" || *mountpoint == "" {
-		log.Println("Error: -namespace and -mount are required (or set BANGFS_NAMESPACE, BANGFS_MOUNTDIR)")
+	if *mountpoint == "" {
+		log.Println("Error: -mount is required (or set BANGFS_MOUNTDIR)")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *backend == "" && *namespace == "" {
+		log.Println("Error: -namespace is required (or set BANGFS_NAMESPACE), or use -backend with -dsn")
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -71,32 +85,64 @@ func main() {
 		os.Exit(0)
 	}
 
-	var bs *bangfuse.BangServer
-	if *dummy {
-		log.Printf("Using file-backed store (namespace=%s)", *namespace)
-		fkv, err := bangfuse.NewFileKVStore(*namespace)
+	var kv bangfuse.KVStore
+	var err error
+	switch {
+	case *backend != "":
+		if *dsn == "" {
+			log.Println("Error: -dsn is required with -backend")
+			flag.Usage()
+			os.Exit(1)
+		}
+		log.Printf("Opening %s backend (dsn=%s)", *backend, *dsn)
+		kv, err = bangfuse.OpenBackend(*backend, *dsn)
 		if err != nil {
-			log.Fatalf("Failed to create file store: %v", err)
+			log.Fatalf("Failed to open backend: %v", err)
 		}
-		bs, err = bangfuse.NewBangServerWithKV(fkv)
+	case *dummy:
+		log.Printf("Using file-backed store (namespace=%s)", *namespace)
+		kv, err = bangfuse.NewFileKVStore(*namespace)
 		if err != nil {
-			log.Fatalf("Failed to initialize: %v", err)
+			log.Fatalf("Failed to create file store: %v", err)
 		}
-	} else {
+	default:
 		if *host == "" {
 			log.Println("Error: -host is required (or set RIAK_HOST), or use -dummy")
 			flag.Usage()
 			os.Exit(1)
 		}
 		log.Printf("Connecting to Riak at %s:%d", *host, *port)
-		var err error
-		bs, err = bangfuse.NewBangServer(*host, uint16(*port), *namespace)
+		kv, err = bangfuse.NewRiakKVStore(*host, uint16(*port), *namespace)
 		if err != nil {
-			log.Fatalf("Failed to initialize: %v", err)
+			log.Fatalf("Failed to connect to backend: %v", err)
 		}
 	}
+	if *cacheMetaEntries > 0 || *cacheChunkBytes > 0 {
+		log.Printf("Caching up to %d metadata entries and %d chunk bytes", *cacheMetaEntries, *cacheChunkBytes)
+		kv = bangfuse.NewCachingKVStore(kv, *cacheMetaEntries, *cacheChunkBytes)
+	}
+	bs, err := bangfuse.NewBangServerWithKV(bangfuse.WrapWithStats(kv))
+	if err != nil {
+		log.Fatalf("Failed to initialize: %v", err)
+	}
 	defer bs.Close()
 
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", bangfuse.MetricsHandler())
+		go func() {
+			log.Printf("Serving KVStore stats on %s/metrics", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				log.Printf("metrics server stopped: %v", err)
+			}
+		}()
+	}
+
+	if *openCache > 0 {
+		bs.SetOpenCacheTTL(*openCache)
+		log.Printf("Open-file metadata cache enabled (ttl=%s)", *openCache)
+	}
+
 	log.Printf("Mounting BangFS (namespace=%s) at %s", *namespace, *mountpoint)
 	if err := bs.Mount(*mountpoint); err != nil {
 		log.Fatalf("Mount failed: %v", err)
@@ -36,57 +36,71 @@ func main() {
 	namespace := flag.String("namespace", envOrDefault("BANGFS_NAMESPACE", ""), "Filesystem namespace (env: BANGFS_NAMESPACE)")
 	dummy := flag.Bool("dummy", false, "Use file-backed store under /tmp instead of Riak")
 	force := flag.Bool("force", false, "Skip confirmation prompt")
+	backend := flag.String("backend", "", fmt.Sprintf("Backend to use (%s); overrides -dummy/-host/-port/-namespace when set", strings.Join(bangfuse.BackendNames(), ", ")))
+	dsn := flag.String("dsn", "", "Backend-specific DSN, required with -backend (e.g. riak://host:8087/ns, file:ns, file:/var/lib/bang.db, s3://bucket/prefix?region=...)")
 
 	flag.Parse()
 
-	if *namespace == "" {
-		log.Println("Error: -namespace is required (or set BANGFS_NAMESPACE)")
+	confirmTarget := *namespace
+	if *backend != "" {
+		confirmTarget = *dsn
+	}
+	if confirmTarget == "" {
+		log.Println("Error: -namespace is required (or set BANGFS_NAMESPACE), or use -backend with -dsn")
 		flag.Usage()
 		os.Exit(1)
 	}
 
 	// Confirm destruction unless -force
 	if !*force {
-		fmt.Printf("WARNING: This will permanently delete all data in namespace '%s'!\n", *namespace)
-		fmt.Printf("  Metadata bucket: %s_bangfs_metadata\n", *namespace)
-		fmt.Printf("  Chunk bucket:    %s_bangfs_chunks\n", *namespace)
-		fmt.Print("\nType the namespace name to confirm: ")
+		fmt.Printf("WARNING: This will permanently delete all data in %q!\n", confirmTarget)
+		if *backend == "" {
+			fmt.Printf("  Metadata bucket: %s_bangfs_metadata\n", *namespace)
+			fmt.Printf("  Chunk bucket:    %s_bangfs_chunks\n", *namespace)
+		}
+		fmt.Printf("\nType %q to confirm: ", confirmTarget)
 
 		reader := bufio.NewReader(os.Stdin)
 		input, _ := reader.ReadString('\n')
 		input = strings.TrimSpace(input)
 
-		if input != *namespace {
+		if input != confirmTarget {
 			log.Fatal("Confirmation failed. Aborting.")
 		}
 	}
 
 	var kv bangfuse.KVStore
-	if *dummy {
+	var err error
+	switch {
+	case *backend != "":
+		log.Printf("Opening %s backend (dsn=%s)", *backend, *dsn)
+		kv, err = bangfuse.OpenBackend(*backend, *dsn)
+		if err != nil {
+			log.Fatalf("Failed to open backend: %v", err)
+		}
+	case *dummy:
 		log.Printf("Using file-backed store (namespace=%s)", *namespace)
-		fkv, err := bangfuse.NewFileKVStore(*namespace)
+		kv, err = bangfuse.NewFileKVStore(*namespace)
 		if err != nil {
 			log.Fatalf("Failed to create file store: %v", err)
 		}
-		kv = fkv
-	} else {
+	default:
 		if *host == "" {
 			log.Println("Error: -host is required (or set RIAK_HOST), or use -dummy")
 			flag.Usage()
 			os.Exit(1)
 		}
 		log.Printf("Connecting to Riak at %s:%d", *host, *port)
-		rkv, err := bangfuse.NewRiakKVStore(*host, uint16(*port), *namespace)
+		kv, err = bangfuse.NewRiakKVStore(*host, uint16(*port), *namespace)
 		if err != nil {
 			log.Fatalf("Failed to connect to backend: %v", err)
 		}
-		kv = rkv
 	}
 	defer kv.Close()
 
 	// Wipe filesystem data
 	log.Printf("Wiping filesystem with namespace '%s'...", *namespace)
-	if err := kv.WipeBackend(); err != nil {
+	if err := kv.WipeBackend(os.Stdout); err != nil {
 		log.Fatalf("Failed to wipe filesystem: %v", err)
 	}
 